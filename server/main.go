@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+
 	"github.com/Software78/encryption-test/docs"
 	handler "github.com/Software78/encryption-test/src/controllers"
 	db "github.com/Software78/encryption-test/src/db"
+	"github.com/Software78/encryption-test/src/jsoncrypt"
 	middleware "github.com/Software78/encryption-test/src/middleware"
 	"github.com/Software78/encryption-test/src/models"
 	repository "github.com/Software78/encryption-test/src/repository"
@@ -34,11 +39,86 @@ import (
 //	@name						Authorization
 
 func main() {
+	// "kdf-params" prints fresh AES_KDF parameters for deriving the key from
+	// AES_PASSPHRASE, then exits
+	if len(os.Args) > 1 && os.Args[1] == "kdf-params" {
+		params, err := middleware.NewKDFParams()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(params)
+		return
+	}
+	// "create-kek <id>" adds a key encryption key to LOCAL_KMS_FILE, creating
+	// the file if needed, then exits
+	if len(os.Args) > 1 && os.Args[1] == "create-kek" {
+		if len(os.Args) != 3 {
+			log.Fatal("usage: create-kek <kek-id>")
+		}
+		kms, err := middleware.LocalKMSFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := kms.CreateKey(os.Args[2]); err != nil {
+			log.Fatal("🚨🚨🚨---failed to create key encryption key---🚨🚨🚨: ", err)
+		}
+		log.Printf("🔐 created key encryption key %s", os.Args[2])
+		return
+	}
+	// "wrap-keys <kek-id>" wraps the keys in AES_KEY_FILE with a key
+	// encryption key from LOCAL_KMS_FILE, and rewraps those wrapped with
+	// another one, then exits. The file is then read with KEY_PROVIDER=local-kms
+	if len(os.Args) > 1 && os.Args[1] == "wrap-keys" {
+		if len(os.Args) != 3 {
+			log.Fatal("usage: wrap-keys <kek-id>")
+		}
+		kms, err := middleware.LocalKMSFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		path := os.Getenv("AES_KEY_FILE")
+		if path == "" {
+			log.Fatal("AES_KEY_FILE environment variable is not set")
+		}
+		keys, err := middleware.WrapKeyFile(context.Background(), kms, path, os.Args[2])
+		if err != nil {
+			log.Fatal("🚨🚨🚨---failed to wrap keys---🚨🚨🚨: ", err)
+		}
+		log.Printf("🔐 wrapped %d keys with %s", keys, os.Args[2])
+		return
+	}
 	docs.SwaggerInfo.Version = "1.0"
 	docs.SwaggerInfo.Host = os.Getenv("HOST")
 	docs.SwaggerInfo.BasePath = ""
 	docs.SwaggerInfo.Schemes = []string{os.Getenv("SCHEMES")}
 	var err error
+	policies := middleware.NewPolicyRegistry(middleware.PolicyRequired)
+	policies.Register("/api/v1/docs", middleware.PolicyDisabled)
+	// The handshake is how clients get a key, so it is plaintext by design
+	policies.Register("/api/v1/crypto/handshake", middleware.PolicyDisabled)
+	policies.Register("/api/v1/crypto/jwks", middleware.PolicyDisabled)
+	policies.Register("/api/v1/crypto/keys", middleware.PolicyDisabled)
+	// Login and register bodies must not be replayable. Only the user's
+	// personal data is encrypted in responses; IDs and timestamps stay readable.
+	// The login session key is always encrypted with the key the login used.
+	policies.Register("/api/v1/auth", middleware.Policy{
+		Request:  middleware.EncryptionRequired,
+		Response: middleware.EncryptionRequired,
+		Signed:   true,
+		Fields:   jsoncrypt.MustTagRules("$.data", models.LoginResponse{}),
+	})
+	for _, route := range policies.Routes() {
+		log.Printf("🔐 encryption policy %-28s %s", route.Prefix, route.Policy)
+	}
+
+	crypto, err := middleware.NewCryptoMiddlewareFromEnv(middleware.WithPolicies(policies))
+	if err != nil {
+		log.Fatal("🚨🚨🚨---failed to create crypto middleware---🚨🚨🚨")
+		fmt.Println(err)
+		log.Panic(err)
+	}
+	cryptoController := handler.NewCryptoController(crypto)
+
 	postgresDb := os.Getenv("POSTGRES_URL")
 	gormDB, err := gorm.Open(postgres.Open(postgresDb), &gorm.Config{})
 	if err != nil {
@@ -47,31 +127,82 @@ func main() {
 	} else {
 		fmt.Println("🚀🚀🚀---ASCENDE SUPERIUS---🚀🚀🚀")
 	}
+
+	// User PII is encrypted at rest, so the serializers must exist before the
+	// models are migrated
+	dataCipher, dataKeys, err := newDataCipher(crypto, gormDB)
+	if err != nil {
+		log.Fatal("🚨🚨🚨---failed to load data keys---🚨🚨🚨: ", err)
+	}
+	db.RegisterEncryptedSerializers(dataCipher)
+	blindIndex, err := crypto.BlindIndex()
+	if err != nil {
+		log.Fatal("🚨🚨🚨---failed to load blind index keys---🚨🚨🚨: ", err)
+	}
+
 	database := db.NewGormDB(gormDB)
 	database.AutoMigrate(&models.User{})
-	userRepository := repository.NewUserRepository(database)
-	userService := service.NewUserService(userRepository)
-	userController := handler.NewUserController(*userService)
-	r := gin.Default()
-	r.Use(pagination.Default())
-	r.Use(middleware.ErrorHandler())
 
-	
+	userRepository := repository.NewUserRepository(database, blindIndex)
 
-	crypto, err := middleware.NewCryptoMiddlewareFromEnv( `/docs/`)
-	if err != nil {
-		log.Fatal("🚨🚨🚨---failed to create crypto middleware---🚨🚨🚨")
-		fmt.Println(err)
-		log.Panic(err)
+	// "migrate" encrypts existing rows, and reseals them after the primary
+	// data key changes or DATA_KEK_ID is first set, then exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		rows, err := db.EncryptColumns(gormDB, &models.User{}, 100)
+		if err != nil {
+			log.Fatal("🚨🚨🚨---failed to encrypt users---🚨🚨🚨: ", err)
+		}
+		log.Printf("🔐 encrypted %d users", rows)
+		return
 	}
-    r.Use(crypto.DecryptRequestMiddleware())
-	// r.Use(crypto.EncryptResponseMiddleware())
+	// "rewrap-data-keys <kek-id>" rewraps the data keys in the data_keys table
+	// with another key encryption key, then exits. The data is not touched;
+	// set DATA_KEK_ID to the new key before restarting
+	if len(os.Args) > 1 && os.Args[1] == "rewrap-data-keys" {
+		if len(os.Args) != 3 {
+			log.Fatal("usage: rewrap-data-keys <kek-id>")
+		}
+		if dataKeys == nil {
+			log.Fatal("DATA_KEK_ID environment variable is not set")
+		}
+		keys, err := dataKeys.Rewrap(context.Background(), os.Args[2])
+		if err != nil {
+			log.Fatal("🚨🚨🚨---failed to rewrap data keys---🚨🚨🚨: ", err)
+		}
+		log.Printf("🔐 rewrapped %d data keys with %s", keys, os.Args[2])
+		return
+	}
+	// "backfill-email-index" indexes existing users, and reindexes them after
+	// the primary index key changes, then exits
+	if len(os.Args) > 1 && os.Args[1] == "backfill-email-index" {
+		rows, err := userRepository.BackfillEmailIndex(100)
+		if err != nil {
+			log.Fatal("🚨🚨🚨---failed to backfill email index---🚨🚨🚨: ", err)
+		}
+		log.Printf("🔐 indexed %d users", rows)
+		return
+	}
+
+	userService := service.NewUserService(userRepository)
+	userController := handler.NewUserController(*userService, crypto)
+	r := gin.Default()
+	r.Use(middleware.ErrorHandler())
 
+	r.Use(crypto.VerifySignatureMiddleware())
+	r.Use(crypto.DecryptRequestMiddleware())
+	r.Use(crypto.EncryptResponseMiddleware())
+	// pagination reads page and size from the query, so it runs once the query is decrypted
+	r.Use(pagination.Default())
 
 	//v1 group
 	v1 := r.Group("/api/v1")
 	v1.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
- // Exclude Swaggo documentation paths (docs/*any)
+
+	//crypto group
+	cryptoGroup := v1.Group("/crypto")
+	cryptoGroup.POST("/handshake", cryptoController.Handshake)
+	cryptoGroup.GET("/jwks", cryptoController.JWKS)
+	cryptoGroup.GET("/keys", cryptoController.Keys)
 
 	//auth group
 	auth := v1.Group("/auth")
@@ -80,3 +211,46 @@ func main() {
 
 	r.Run(":8080")
 }
+
+// newDataCipher returns the cipher for data at rest. With DATA_KEK_ID set,
+// data is encrypted with the data key DATA_KEY_ID (default "app-data") from
+// the data_keys table, wrapped by that key encryption key from
+// LOCAL_KMS_FILE, and the manager of those data keys is returned too. Values
+// sealed with the key file's data_keys still decrypt until "migrate" reseals
+// them. Without DATA_KEK_ID, the key file's data_keys are used directly.
+func newDataCipher(crypto *middleware.CryptoMiddleware, gormDB *gorm.DB) (db.Cipher, *middleware.DataKeyManager, error) {
+	legacy, err := crypto.DataCipher()
+	kekID := os.Getenv("DATA_KEK_ID")
+	if kekID == "" {
+		if err != nil {
+			return nil, nil, err
+		}
+		return legacy, nil, nil
+	}
+	if err != nil && !errors.Is(err, middleware.ErrNoDataKeys) {
+		return nil, nil, err
+	}
+
+	kms, err := middleware.LocalKMSFromEnv()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !slices.Contains(kms.KEKIDs(), kekID) {
+		return nil, nil, fmt.Errorf("DATA_KEK_ID %q is not a key encryption key in LOCAL_KMS_FILE", kekID)
+	}
+	store := db.NewGormDataKeyStore(gormDB)
+	if err := store.AutoMigrate(); err != nil {
+		return nil, nil, err
+	}
+	dataKeyID := os.Getenv("DATA_KEY_ID")
+	if dataKeyID == "" {
+		dataKeyID = "app-data"
+	}
+
+	manager := middleware.NewDataKeyManager(kms, store, kekID)
+	cipher := manager.Cipher(context.Background(), dataKeyID)
+	if legacy != nil {
+		cipher = cipher.WithFallback(legacy)
+	}
+	return cipher, manager, nil
+}
@@ -1,8 +1,8 @@
 package controllers
 
 import (
-	"encoding/json"
-	"fmt"
+	"encoding/base64"
+	"errors"
 	"net/http"
 
 	middleware "github.com/Software78/encryption-test/src/middleware"
@@ -16,22 +16,25 @@ import (
 
 type UserController struct {
 	userService services.UserService
+	crypto      *middleware.CryptoMiddleware
 }
 
-func NewUserController(service services.UserService) *UserController {
-	return &UserController{userService: service}
+func NewUserController(service services.UserService, crypto *middleware.CryptoMiddleware) *UserController {
+	return &UserController{userService: service, crypto: crypto}
 }
 
 // Login godoc
 //
 //	@Summary		Login a user
-//	@Description	Login a user
+//	@Description	Login a user and start a login session. The session key is returned once, encrypted;
+//	@Description	later requests send the session ID in X-Session-ID and are encrypted with that key.
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
 //	@Param			user	body		models.Login	true	"User object that needs to be created"
-//	@Success		200		{object}	models.SuccessResponse
+//	@Success		200		{object}	models.SuccessResponse{data=models.LoginResponse}
 //	@Failure		400		{object}	models.HTTPError
+//	@Failure		503		{object}	models.HTTPError
 //	@Router			/auth/login [post]
 func (h *UserController) Login(c *gin.Context) {
 	login := &models.Login{}
@@ -39,24 +42,28 @@ func (h *UserController) Login(c *gin.Context) {
 		c.Error(err)
 		return
 	}
-	decryptedJSON := c.MustGet("decryptedJSON").(map[string]interface{})
-	decryptedLogin := models.Login{
-		Email:    decryptedJSON["email"].(string),
-		Password: decryptedJSON["password"].(string),
-	}
-	user, err := h.userService.Login(&decryptedLogin)
+	user, err := h.userService.Login(login)
 	if err != nil {
 		c.Error(err)
 		return
 	}
-	crypto, _ := middleware.NewCryptoMiddlewareFromEnv( `/docs/`)
-	encryptedUser , err :=	crypto.EncryptValues(user)
-	fmt.Println(encryptedUser)
+	session, err := h.crypto.IssueSessionKey(user.ID.String())
+	if errors.Is(err, middleware.ErrSessionStoreFull) {
+		c.Error(middleware.NewAppError(http.StatusServiceUnavailable, err.Error(), nil))
+		return
+	}
 	if err != nil {
 		c.Error(err)
 		return
 	}
-	c.JSON(http.StatusOK,  models.SuccessResponse{Code: http.StatusOK, Success: true, Data: json.RawMessage(encryptedUser)})
+	c.JSON(http.StatusOK, models.SuccessResponse{Code: http.StatusOK, Success: true, Data: models.LoginResponse{
+		User: *user,
+		Session: models.SessionKey{
+			SessionID: session.ID,
+			Key:       base64.StdEncoding.EncodeToString(session.Key),
+			ExpiresAt: session.ExpiresAt,
+		},
+	}})
 }
 
 
@@ -77,30 +84,16 @@ func (h *UserController) Register(c *gin.Context) {
 		c.Error(err)
 		return
 	}
-	decryptedJSON := c.MustGet("decryptedJSON").(map[string]interface{})
-	decryptedRegister := models.Register{
-		FirstName: decryptedJSON["first_name"].(string),
-		LastName:  decryptedJSON["last_name"].(string),
-		Email:     decryptedJSON["email"].(string),
-		Password:  decryptedJSON["password"].(string),
-	}
-	_, err := h.userService.Register(&decryptedRegister)
-	if err != nil {
-		c.Error(err)
-		return
-	}
-	registeredUser,err := h.userService.GetUserByEmail(decryptedRegister.Email)
-
+	_, err := h.userService.Register(register)
 	if err != nil {
 		c.Error(err)
 		return
 	}
-	crypto, _ := middleware.NewCryptoMiddlewareFromEnv( `/docs/`)
-	encryptedUser , err :=	crypto.EncryptValues(registeredUser)
+	registeredUser,err := h.userService.GetUserByEmail(register.Email)
 
 	if err != nil {
 		c.Error(err)
 		return
 	}
-	c.JSON(http.StatusOK,  models.SuccessResponse{Code: http.StatusOK, Success: true, Data: json.RawMessage(encryptedUser)})
+	c.JSON(http.StatusOK, models.SuccessResponse{Code: http.StatusOK, Success: true, Data: registeredUser})
 }
@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	middleware "github.com/Software78/encryption-test/src/middleware"
+	models "github.com/Software78/encryption-test/src/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CryptoController struct {
+	crypto *middleware.CryptoMiddleware
+}
+
+func NewCryptoController(crypto *middleware.CryptoMiddleware) *CryptoController {
+	return &CryptoController{crypto: crypto}
+}
+
+// Handshake godoc
+//
+//	@Summary		Agree on a session key
+//	@Description	X25519 key agreement. The session key is HKDF-SHA256(shared secret, salt, "encryption-test handshake v1" || client public key || server public key). Send the returned session_id in the X-Session-ID header to encrypt with it.
+//	@Tags			crypto
+//	@Accept			json
+//	@Produce		json
+//	@Param			handshake	body		models.HandshakeRequest	true	"Client X25519 public key"
+//	@Success		200			{object}	models.SuccessResponse{data=models.HandshakeResponse}
+//	@Failure		400			{object}	models.HTTPError
+//	@Failure		503			{object}	models.HTTPError
+//	@Router			/crypto/handshake [post]
+func (h *CryptoController) Handshake(c *gin.Context) {
+	request := &models.HandshakeRequest{}
+	if err := c.ShouldBindJSON(request); err != nil {
+		c.Error(err)
+		return
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(request.PublicKey)
+	if err != nil {
+		c.Error(middleware.NewValidationError("public_key", "public_key must be base64 encoded"))
+		return
+	}
+	result, err := h.crypto.Handshake(publicKey)
+	if err != nil {
+		if errors.Is(err, middleware.ErrInvalidPeerKey) {
+			c.Error(middleware.NewValidationError("public_key", err.Error()))
+			return
+		}
+		if errors.Is(err, middleware.ErrSessionStoreFull) {
+			c.Error(middleware.NewAppError(http.StatusServiceUnavailable, err.Error(), nil))
+			return
+		}
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, models.SuccessResponse{Code: http.StatusOK, Success: true, Data: models.HandshakeResponse{
+		SessionID: result.SessionID,
+		PublicKey: base64.StdEncoding.EncodeToString(result.ServerPublicKey),
+		Salt:      base64.StdEncoding.EncodeToString(result.Salt),
+		ExpiresAt: result.ExpiresAt,
+	}})
+}
+
+// JWKS godoc
+//
+//	@Summary		Public keys for JWE requests
+//	@Description	JSON Web Key Set with the X25519 and P-256 keys to use with ECDH-ES and ECDH-ES+A256KW. Send JWE bodies as application/jose (compact) or application/jose+json (JSON serialization).
+//	@Tags			crypto
+//	@Produce		json
+//	@Success		200	{object}	map[string][]middleware.JWK
+//	@Failure		404	{object}	models.HTTPError
+//	@Router			/crypto/jwks [get]
+func (h *CryptoController) JWKS(c *gin.Context) {
+	keys, err := h.crypto.JWKS()
+	if err != nil {
+		if errors.Is(err, middleware.ErrNoJWEKeys) {
+			c.Error(middleware.NewAppError(http.StatusNotFound, err.Error(), nil))
+			return
+		}
+		c.Error(err)
+		return
+	}
+	// A bare JWK Set rather than a SuccessResponse, so JOSE libraries can fetch it directly
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// Keys godoc
+//
+//	@Summary		Public keys for HPKE requests
+//	@Description	X25519 keys for HPKE (RFC 9180) base mode with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256 and AES-256-GCM, primary first. Send {"kid","enc","ct"} as application/vnd.hpke+json with info "encryption-test hpke v1"; the response {"ct"} is AES-256-GCM under Export("encryption-test hpke response v1", 32).
+//	@Tags			crypto
+//	@Produce		json
+//	@Success		200	{object}	models.SuccessResponse{data=[]middleware.HPKEPublicKey}
+//	@Failure		404	{object}	models.HTTPError
+//	@Router			/crypto/keys [get]
+func (h *CryptoController) Keys(c *gin.Context) {
+	keys, err := h.crypto.HPKEPublicKeys()
+	if err != nil {
+		if errors.Is(err, middleware.ErrNoHPKEKeys) {
+			c.Error(middleware.NewAppError(http.StatusNotFound, err.Error(), nil))
+			return
+		}
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, models.SuccessResponse{Code: http.StatusOK, Success: true, Data: keys})
+}
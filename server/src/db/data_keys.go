@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Software78/encryption-test/src/middleware"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dataKeyRecord is a row of the data_keys table.
+type dataKeyRecord struct {
+	ID        string `gorm:"primaryKey"`
+	KEKID     string `gorm:"column:kek_id;not null"`
+	Wrapped   []byte `gorm:"not null"`
+	CreatedAt time.Time
+	WrappedAt time.Time
+}
+
+func (dataKeyRecord) TableName() string {
+	return "data_keys"
+}
+
+// GormDataKeyStore keeps wrapped data keys in the data_keys table, so they
+// live and are backed up with the data they encrypt.
+type GormDataKeyStore struct {
+	db *gorm.DB
+}
+
+func NewGormDataKeyStore(db *gorm.DB) *GormDataKeyStore {
+	return &GormDataKeyStore{db: db}
+}
+
+// AutoMigrate creates or updates the data_keys table.
+func (s *GormDataKeyStore) AutoMigrate() error {
+	return s.db.AutoMigrate(&dataKeyRecord{})
+}
+
+func (s *GormDataKeyStore) Get(ctx context.Context, id string) (middleware.DataKey, error) {
+	var record dataKeyRecord
+	err := s.db.WithContext(ctx).Where("id = ?", id).Take(&record).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return middleware.DataKey{}, fmt.Errorf("%w: %q", middleware.ErrDataKeyNotFound, id)
+	}
+	if err != nil {
+		return middleware.DataKey{}, err
+	}
+	return record.dataKey(), nil
+}
+
+func (s *GormDataKeyStore) Create(ctx context.Context, key middleware.DataKey) error {
+	// DO NOTHING instead of a unique violation, which each driver reports differently
+	result := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(newDataKeyRecord(key))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %q", middleware.ErrDataKeyExists, key.ID)
+	}
+	return nil
+}
+
+func (s *GormDataKeyStore) Update(ctx context.Context, key middleware.DataKey) error {
+	result := s.db.WithContext(ctx).Model(&dataKeyRecord{}).Where("id = ?", key.ID).Updates(map[string]interface{}{
+		"kek_id":     key.KEKID,
+		"wrapped":    key.Wrapped,
+		"wrapped_at": key.WrappedAt,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("%w: %q", middleware.ErrDataKeyNotFound, key.ID)
+	}
+	return nil
+}
+
+func (s *GormDataKeyStore) Delete(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Where("id = ?", id).Delete(&dataKeyRecord{}).Error
+}
+
+func (s *GormDataKeyStore) List(ctx context.Context) ([]middleware.DataKey, error) {
+	var records []dataKeyRecord
+	if err := s.db.WithContext(ctx).Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	keys := make([]middleware.DataKey, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, record.dataKey())
+	}
+	return keys, nil
+}
+
+func newDataKeyRecord(key middleware.DataKey) *dataKeyRecord {
+	return &dataKeyRecord{ID: key.ID, KEKID: key.KEKID, Wrapped: key.Wrapped, CreatedAt: key.CreatedAt, WrappedAt: key.WrappedAt}
+}
+
+func (r dataKeyRecord) dataKey() middleware.DataKey {
+	return middleware.DataKey{ID: r.ID, KEKID: r.KEKID, Wrapped: r.Wrapped, CreatedAt: r.CreatedAt, WrappedAt: r.WrappedAt}
+}
@@ -11,6 +11,8 @@ type Database interface { // Define the interface
     Find(dest interface{}, conds ...interface{}) *gorm.DB
 	Where(query interface{}, args ...interface{}) *gorm.DB
 	AutoMigrate(dst ...interface{}) error
+	Model(value interface{}) *gorm.DB
+	FindInBatches(dest interface{}, batchSize int, fc func(tx *gorm.DB, batch int) error) *gorm.DB
     // Add all the other methods you use from gorm.DB
 }
 
@@ -49,3 +51,11 @@ func (g *GormDB) AutoMigrate(dst ...interface{}) error {
 func (g *GormDB) Where(query interface{}, args ...interface{}) *gorm.DB {
 	return g.DB.Where(query, args...)
 }
+
+func (g *GormDB) Model(value interface{}) *gorm.DB {
+	return g.DB.Model(value)
+}
+
+func (g *GormDB) FindInBatches(dest interface{}, batchSize int, fc func(tx *gorm.DB, batch int) error) *gorm.DB {
+	return g.DB.FindInBatches(dest, batchSize, fc)
+}
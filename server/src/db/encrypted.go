@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Cipher encrypts column values. middleware.DataCipher implements it.
+type Cipher interface {
+	Encrypt(plaintext []byte) (string, error)
+	EncryptDeterministic(plaintext []byte) (string, error)
+	Decrypt(ciphertext string) ([]byte, error)
+	// IsEncrypted reports whether value is well-formed ciphertext. Anything
+	// else is read as plaintext that hasn't been encrypted yet, so it must
+	// not go by a prefix alone.
+	IsEncrypted(value string) bool
+}
+
+// RegisterEncryptedSerializers registers two serializers for string columns
+// holding personal data:
+//
+//	FirstName string `gorm:"serializer:encrypted"`
+//	Code      string `gorm:"unique;serializer:encrypted_deterministic"`
+//
+// "encrypted" uses a random nonce per value. "encrypted_deterministic" gives
+// equal ciphertexts for equal values, so the column can be unique and queried
+// with struct conditions like Where(&Voucher{Code: code}, "Code"); plain
+// string conditions compare against the ciphertext and never match. Columns
+// that need normalizing before they are compared, like emails, are better
+// served by a blind index next to an "encrypted" column.
+//
+// They must be registered before the models using them are migrated or queried.
+func RegisterEncryptedSerializers(cipher Cipher) {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{Cipher: cipher})
+	schema.RegisterSerializer("encrypted_deterministic", EncryptedSerializer{Cipher: cipher, Deterministic: true})
+}
+
+// EncryptedSerializer encrypts string fields on write and decrypts them on
+// read. Values that aren't encrypted yet are read as they are, so a table can
+// be migrated with EncryptColumns while it is in use.
+type EncryptedSerializer struct {
+	Cipher        Cipher
+	Deterministic bool
+}
+
+func (s EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	fieldValue := field.ReflectValueOf(ctx, dst)
+	if fieldValue.Kind() != reflect.String {
+		return fmt.Errorf("encrypted serializer: field %s must be a string", field.Name)
+	}
+
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("encrypted serializer: unsupported value %T for field %s", dbValue, field.Name)
+	}
+
+	if s.Cipher.IsEncrypted(value) {
+		plaintext, err := s.Cipher.Decrypt(value)
+		if err != nil {
+			return fmt.Errorf("encrypted serializer: field %s: %w", field.Name, err)
+		}
+		value = string(plaintext)
+	}
+	fieldValue.SetString(value)
+	return nil
+}
+
+func (s EncryptedSerializer) Value(_ context.Context, field *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	value, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted serializer: field %s must be a string", field.Name)
+	}
+	if s.Deterministic {
+		return s.Cipher.EncryptDeterministic([]byte(value))
+	}
+	return s.Cipher.Encrypt([]byte(value))
+}
+
+// EncryptColumns re-encrypts every column of model that uses an encrypted
+// serializer, in batches of batchSize rows with one transaction per batch.
+// Plaintext rows get encrypted and rows sealed with an older data key are
+// resealed with the primary one. Other columns, including updated_at, are
+// left alone. It returns the number of rows written.
+func EncryptColumns(db *gorm.DB, model interface{}, batchSize int) (int64, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(model); err != nil {
+		return 0, err
+	}
+	var columns []string
+	for _, field := range stmt.Schema.Fields {
+		if _, ok := field.Serializer.(EncryptedSerializer); ok {
+			columns = append(columns, field.DBName)
+		}
+	}
+	if len(columns) == 0 {
+		return 0, nil
+	}
+
+	rows := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	var written int64
+	result := db.Model(model).FindInBatches(rows.Interface(), batchSize, func(_ *gorm.DB, _ int) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			batch := rows.Elem()
+			for i := 0; i < batch.Len(); i++ {
+				row := batch.Index(i).Addr().Interface()
+				if err := tx.Model(row).Select(columns).UpdateColumns(row).Error; err != nil {
+					return err
+				}
+			}
+			written += int64(batch.Len())
+			return nil
+		})
+	})
+	return written, result.Error
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Software78/encryption-test/src/middleware"
+	"gorm.io/gorm/schema"
+)
+
+// fakeCipher marks values instead of encrypting them, so tests can see what
+// the serializer asked for.
+type fakeCipher struct {
+	sealed int
+}
+
+func (c *fakeCipher) Encrypt(plaintext []byte) (string, error) {
+	c.sealed++
+	return "rnd" + strconv.Itoa(c.sealed) + ":" + string(plaintext), nil
+}
+
+func (c *fakeCipher) EncryptDeterministic(plaintext []byte) (string, error) {
+	return "det:" + string(plaintext), nil
+}
+
+func (c *fakeCipher) Decrypt(ciphertext string) ([]byte, error) {
+	_, plaintext, ok := strings.Cut(ciphertext, ":")
+	if !ok || plaintext == "corrupt" {
+		return nil, errors.New("cannot decrypt")
+	}
+	return []byte(plaintext), nil
+}
+
+func (c *fakeCipher) IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, "rnd") || strings.HasPrefix(value, "det:")
+}
+
+type encryptedModel struct {
+	ID        uint
+	FirstName string `gorm:"serializer:encrypted"`
+	Code      string `gorm:"serializer:encrypted_deterministic"`
+	Count     int    `gorm:"serializer:encrypted"`
+}
+
+// parseEncryptedModel registers cipher and returns the fields of encryptedModel.
+func parseEncryptedModel(t *testing.T, cipher Cipher) *schema.Schema {
+	t.Helper()
+	RegisterEncryptedSerializers(cipher)
+	s, err := schema.Parse(&encryptedModel{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestEncryptedSerializerValue(t *testing.T) {
+	cipher := &fakeCipher{}
+	s := parseEncryptedModel(t, cipher)
+	ctx := context.Background()
+
+	firstName := s.LookUpField("FirstName")
+	first, err := firstName.Serializer.(EncryptedSerializer).Value(ctx, firstName, reflect.Value{}, "Jane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := firstName.Serializer.(EncryptedSerializer).Value(ctx, firstName, reflect.Value{}, "Jane")
+	if first == second || !strings.HasSuffix(first.(string), ":Jane") {
+		t.Errorf("encrypted values %q and %q, want two random encryptions of Jane", first, second)
+	}
+
+	code := s.LookUpField("Code")
+	value, err := code.Serializer.(EncryptedSerializer).Value(ctx, code, reflect.Value{}, "VOUCHER")
+	if err != nil || value != "det:VOUCHER" {
+		t.Errorf("deterministic value = %v, %v, want det:VOUCHER", value, err)
+	}
+
+	count := s.LookUpField("Count")
+	if _, err := count.Serializer.(EncryptedSerializer).Value(ctx, count, reflect.Value{}, 3); err == nil {
+		t.Error("Value accepted a non-string field")
+	}
+}
+
+func TestEncryptedSerializerScan(t *testing.T) {
+	s := parseEncryptedModel(t, &fakeCipher{})
+	ctx := context.Background()
+	field := s.LookUpField("FirstName")
+	serializer := field.Serializer.(EncryptedSerializer)
+
+	for _, tc := range []struct {
+		name    string
+		dbValue interface{}
+		want    string
+		ok      bool
+	}{
+		{"encrypted string", "rnd1:Jane", "Jane", true},
+		{"encrypted bytes", []byte("det:Jane"), "Jane", true},
+		{"plaintext not yet migrated", "Jane", "Jane", true},
+		{"null", nil, "", true},
+		{"corrupt", "rnd1:corrupt", "", false},
+		{"other type", 42, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var model encryptedModel
+			err := serializer.Scan(ctx, field, reflect.ValueOf(&model), tc.dbValue)
+			if (err == nil) != tc.ok {
+				t.Fatalf("Scan = %v, want success %t", err, tc.ok)
+			}
+			if model.FirstName != tc.want {
+				t.Errorf("FirstName = %q, want %q", model.FirstName, tc.want)
+			}
+		})
+	}
+
+	count := s.LookUpField("Count")
+	var model encryptedModel
+	if err := count.Serializer.(EncryptedSerializer).Scan(ctx, count, reflect.ValueOf(&model), "rnd1:3"); err == nil {
+		t.Error("Scan accepted a non-string field")
+	}
+}
+
+func TestEncryptedSerializerWithDataCipher(t *testing.T) {
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := middleware.NewKeyring(middleware.Key{ID: "data-1", Material: material, Status: middleware.KeyPrimary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher, err := middleware.NewDataCipher(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := parseEncryptedModel(t, cipher)
+	ctx := context.Background()
+
+	for _, name := range []string{"FirstName", "Code"} {
+		field := s.LookUpField(name)
+		serializer := field.Serializer.(EncryptedSerializer)
+		stored, err := serializer.Value(ctx, field, reflect.Value{}, "Jane")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored == "Jane" || !cipher.IsEncrypted(stored.(string)) {
+			t.Errorf("%s stored as %q", name, stored)
+		}
+		var model encryptedModel
+		if err := serializer.Scan(ctx, field, reflect.ValueOf(&model), stored); err != nil {
+			t.Fatal(err)
+		}
+		if got := reflect.ValueOf(model).FieldByName(name).String(); got != "Jane" {
+			t.Errorf("%s read back as %q", name, got)
+		}
+	}
+
+	// Plaintext from before encryption at rest may look like an envelope
+	field := s.LookUpField("FirstName")
+	for _, legacy := range []string{"v2: see notes", "v2:data-1:not base64"} {
+		var model encryptedModel
+		if err := field.Serializer.(EncryptedSerializer).Scan(ctx, field, reflect.ValueOf(&model), legacy); err != nil {
+			t.Errorf("Scan(%q) = %v", legacy, err)
+		}
+		if model.FirstName != legacy {
+			t.Errorf("Scan(%q) = %q, want the plaintext as stored", legacy, model.FirstName)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package jsoncrypt walks decoded JSON values so their leaves can be
+// encrypted or decrypted in place, whatever the shape of the document.
+package jsoncrypt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Step is one step of a Path: an object key, or an array index when IsIndex is set.
+type Step struct {
+	Key     string
+	Index   int
+	IsIndex bool
+}
+
+// Path locates a value inside a JSON document. The root is the empty path.
+type Path []Step
+
+// String formats the path as a JSONPath, e.g. $.users[2].email. Keys that
+// aren't plain identifiers are quoted: $['first name'].
+func (p Path) String() string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, step := range p {
+		switch {
+		case step.IsIndex:
+			b.WriteString("[" + strconv.Itoa(step.Index) + "]")
+		case isIdentifier(step.Key):
+			b.WriteString("." + step.Key)
+		default:
+			b.WriteString("['" + strings.ReplaceAll(step.Key, "'", `\'`) + "']")
+		}
+	}
+	return b.String()
+}
+
+func (p Path) child(step Step) Path {
+	// The full slice expression makes append copy, so siblings never share a backing array
+	return append(p[:len(p):len(p)], step)
+}
+
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && (i == 0 || !(r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Visitor is called for every leaf of a JSON value: strings, json.Number,
+// float64, bool and nil. It returns the value to put in its place.
+type Visitor func(path Path, value interface{}) (interface{}, error)
+
+// Walk calls visit for every leaf of value, which is either a leaf itself or
+// a tree of map[string]interface{} and []interface{} as produced by Decode.
+// Objects and arrays are rewritten in place; the (possibly replaced) root is
+// returned. Object keys are visited in sorted order. Errors are wrapped with
+// the path of the leaf.
+func Walk(value interface{}, visit Visitor) (interface{}, error) {
+	return walk(nil, value, visit)
+}
+
+func walk(path Path, value interface{}, visit Visitor) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			item, err := walk(path.child(Step{Key: key}), v[key], visit)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = item
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			item, err := walk(path.child(Step{Index: i, IsIndex: true}), item, visit)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+		return v, nil
+	default:
+		visited, err := visit(path, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return visited, nil
+	}
+}
+
+// Decode parses a single JSON value of any kind, keeping numbers as
+// json.Number so large integers and decimals survive a round trip.
+func Decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("invalid JSON: unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+// ToValue converts a Go value to the tree Walk expects by round-tripping it
+// through encoding/json.
+func ToValue(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// Transform decodes data, walks it with visit and encodes the result.
+func Transform(data []byte, visit Visitor) ([]byte, error) {
+	value, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	value, err = Walk(value, visit)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,137 @@
+package jsoncrypt
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPathString(t *testing.T) {
+	for _, tc := range []struct {
+		path Path
+		want string
+	}{
+		{nil, "$"},
+		{Path{{Key: "users"}, {Index: 2, IsIndex: true}, {Key: "email"}}, "$.users[2].email"},
+		{Path{{Key: "first name"}}, "$['first name']"},
+		{Path{{Key: "it's"}}, `$['it\'s']`},
+		{Path{{Key: "2fa"}}, "$['2fa']"},
+		{Path{{Key: "_id9"}}, "$._id9"},
+	} {
+		if got := tc.path.String(); got != tc.want {
+			t.Errorf("%#v.String() = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want interface{}
+	}{
+		{`"a"`, "a"},
+		{`12345678901234567890`, json.Number("12345678901234567890")},
+		{`0.1`, json.Number("0.1")},
+		{`true`, true},
+		{`null`, nil},
+		{` {"a":1} `, map[string]interface{}{"a": json.Number("1")}},
+	} {
+		got, err := Decode([]byte(tc.in))
+		if err != nil {
+			t.Errorf("Decode(%s): %v", tc.in, err)
+			continue
+		}
+		if gotJSON, _ := json.Marshal(got); string(gotJSON) != strings.TrimSpace(tc.in) {
+			t.Errorf("Decode(%s) = %#v", tc.in, got)
+		}
+	}
+
+	for _, in := range []string{``, `{"a":1}{"b":2}`, `{"a":1} x`, `{`} {
+		if _, err := Decode([]byte(in)); err == nil {
+			t.Errorf("Decode(%q) accepted invalid JSON", in)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	value, err := Decode([]byte(`{"b":[1,{"c":"x"}],"a":null,"d":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visited []string
+	walked, err := Walk(value, func(path Path, leaf interface{}) (interface{}, error) {
+		visited = append(visited, path.String())
+		return path.String(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys in sorted order, arrays in order, empty objects have no leaves
+	if got, want := strings.Join(visited, " "), "$.a $.b[0] $.b[1].c"; got != want {
+		t.Errorf("visited %s, want %s", got, want)
+	}
+	if got, _ := json.Marshal(walked); string(got) != `{"a":"$.a","b":["$.b[0]",{"c":"$.b[1].c"}],"d":{}}` {
+		t.Errorf("Walk result = %s", got)
+	}
+
+	// A leaf root is visited with the empty path and replaced
+	root, err := Walk("x", func(path Path, leaf interface{}) (interface{}, error) {
+		if len(path) != 0 {
+			t.Errorf("root leaf path = %s", path)
+		}
+		return 1, nil
+	})
+	if err != nil || root != 1 {
+		t.Errorf("Walk of a leaf = %v, %v", root, err)
+	}
+}
+
+func TestWalkError(t *testing.T) {
+	value, _ := Decode([]byte(`{"users":[{"email":"a"},{"email":"b"}]}`))
+	failure := errors.New("cannot encrypt")
+	_, err := Walk(value, func(path Path, leaf interface{}) (interface{}, error) {
+		if leaf == "b" {
+			return nil, failure
+		}
+		return leaf, nil
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Walk = %v, want the visitor's error", err)
+	}
+	if !strings.HasPrefix(err.Error(), "$.users[1].email: ") {
+		t.Errorf("error %q does not name the path", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	out, err := Transform([]byte(`{"n":12345678901234567890,"s":"x","list":["y",true]}`), func(path Path, leaf interface{}) (interface{}, error) {
+		if s, ok := leaf.(string); ok {
+			return strings.ToUpper(s), nil
+		}
+		return leaf, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Large numbers survive untouched
+	if string(out) != `{"list":["Y",true],"n":12345678901234567890,"s":"X"}` {
+		t.Errorf("Transform = %s", out)
+	}
+}
+
+func TestToValue(t *testing.T) {
+	value, err := ToValue(struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+		Age  int      `json:"age"`
+	}{"Jane", []string{"a"}, 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := value.(map[string]interface{})
+	if object["name"] != "Jane" || object["age"] != json.Number("42") || object["tags"].([]interface{})[0] != "a" {
+		t.Errorf("ToValue = %#v", value)
+	}
+}
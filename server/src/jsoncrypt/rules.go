@@ -0,0 +1,359 @@
+package jsoncrypt
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ruleStepKind int
+
+const (
+	stepKey ruleStepKind = iota
+	stepIndex
+	stepWildcard // .* or [*]: any key or index
+	stepDescend  // ..: the next step may match at any depth
+)
+
+type ruleStep struct {
+	kind  ruleStepKind
+	key   string
+	index int
+}
+
+// Rule selects values by a subset of JSONPath:
+//
+//	$.data.email        object keys
+//	$['first name']     quoted keys
+//	$.items[0].id       array indexes
+//	$.items[*].id       any key or index (also .*)
+//	$..email            a key at any depth
+//
+// A rule selecting an object or array selects every leaf below it.
+type Rule struct {
+	expr  string
+	steps []ruleStep
+}
+
+// ParseRule compiles a JSONPath expression.
+func ParseRule(expr string) (Rule, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(expr), "$")
+	if !ok {
+		return Rule{}, fmt.Errorf("jsonpath %q must start with $", expr)
+	}
+
+	var steps []ruleStep
+	for rest != "" {
+		var step ruleStep
+		var err error
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			steps = append(steps, ruleStep{kind: stepDescend})
+			step, rest, err = parseName(rest[2:])
+		case rest[0] == '.':
+			step, rest, err = parseName(rest[1:])
+		case rest[0] == '[':
+			step, rest, err = parseBracket(rest[1:])
+		default:
+			err = fmt.Errorf("unexpected %q", rest)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("jsonpath %q: %w", expr, err)
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) > 0 && steps[len(steps)-1].kind == stepDescend {
+		return Rule{}, fmt.Errorf("jsonpath %q: .. must be followed by a name", expr)
+	}
+	return Rule{expr: expr, steps: steps}, nil
+}
+
+func parseName(s string) (ruleStep, string, error) {
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+	name := s[:end]
+	switch {
+	case name == "":
+		return ruleStep{}, "", fmt.Errorf("empty name")
+	case name == "*":
+		return ruleStep{kind: stepWildcard}, s[end:], nil
+	default:
+		return ruleStep{kind: stepKey, key: name}, s[end:], nil
+	}
+}
+
+func parseBracket(s string) (ruleStep, string, error) {
+	if strings.HasPrefix(s, "*]") {
+		return ruleStep{kind: stepWildcard}, s[2:], nil
+	}
+	if s != "" && (s[0] == '\'' || s[0] == '"') {
+		quote := s[0]
+		var key strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s):
+				i++
+				key.WriteByte(s[i])
+			case s[i] == quote:
+				if !strings.HasPrefix(s[i+1:], "]") {
+					return ruleStep{}, "", fmt.Errorf("missing ] after quoted name")
+				}
+				return ruleStep{kind: stepKey, key: key.String()}, s[i+2:], nil
+			default:
+				key.WriteByte(s[i])
+			}
+		}
+		return ruleStep{}, "", fmt.Errorf("unterminated quoted name")
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return ruleStep{}, "", fmt.Errorf("missing ]")
+	}
+	index, err := strconv.Atoi(s[:end])
+	if err != nil || index < 0 {
+		return ruleStep{}, "", fmt.Errorf("invalid index %q", s[:end])
+	}
+	return ruleStep{kind: stepIndex, index: index}, s[end+1:], nil
+}
+
+func (r Rule) String() string {
+	return r.expr
+}
+
+// Match reports whether the rule selects path or one of its ancestors.
+func (r Rule) Match(path Path) bool {
+	return matchSteps(r.steps, path)
+}
+
+func matchSteps(steps []ruleStep, path Path) bool {
+	if len(steps) == 0 {
+		return true
+	}
+	step := steps[0]
+	if step.kind == stepDescend {
+		for i := 0; i < len(path); i++ {
+			if matchSteps(steps[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	switch step.kind {
+	case stepKey:
+		if path[0].IsIndex || path[0].Key != step.key {
+			return false
+		}
+	case stepIndex:
+		if !path[0].IsIndex || path[0].Index != step.index {
+			return false
+		}
+	}
+	return matchSteps(steps[1:], path[1:])
+}
+
+// Rules is a set of rules; a path is selected if any rule matches it.
+type Rules []Rule
+
+// ParseRules compiles several JSONPath expressions.
+func ParseRules(exprs ...string) (Rules, error) {
+	rules := make(Rules, 0, len(exprs))
+	for _, expr := range exprs {
+		rule, err := ParseRule(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// MustParseRules is ParseRules for rules fixed at startup. It panics on an invalid expression.
+func MustParseRules(exprs ...string) Rules {
+	rules, err := ParseRules(exprs...)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func (rs Rules) Match(path Path) bool {
+	for _, rule := range rs {
+		if rule.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs Rules) String() string {
+	exprs := make([]string, len(rs))
+	for i, rule := range rs {
+		exprs[i] = rule.expr
+	}
+	return "[" + strings.Join(exprs, " ") + "]"
+}
+
+// Select returns a Visitor that applies visit to the leaves rules select and
+// leaves every other leaf unchanged.
+func Select(rules Rules, visit Visitor) Visitor {
+	return func(path Path, value interface{}) (interface{}, error) {
+		if !rules.Match(path) {
+			return value, nil
+		}
+		return visit(path, value)
+	}
+}
+
+// TagName is the struct tag marking sensitive fields:
+//
+//	Email string `json:"email" crypt:"encrypt"`
+const TagName = "crypt"
+
+type tagRulesKey struct {
+	root string
+	typ  reflect.Type
+}
+
+var tagRulesCache sync.Map // tagRulesKey -> Rules
+
+// TagRules returns a rule for every field of v's type tagged crypt:"encrypt",
+// named the way encoding/json names it and placed under root, e.g.
+// TagRules("$.data", models.User{}) gives $.data.email for a tagged Email.
+// Nested structs, pointers, slices and maps are followed. v may be a value or
+// a nil pointer of the type. The result is cached per type. Where a type
+// contains itself, the nested copy is selected as a whole.
+func TagRules(root string, v interface{}) (Rules, error) {
+	typ := reflect.TypeOf(v)
+	if typ == nil {
+		return nil, nil
+	}
+	key := tagRulesKey{root: root, typ: typ}
+	if cached, ok := tagRulesCache.Load(key); ok {
+		return cached.(Rules), nil
+	}
+
+	var exprs []string
+	collectTagRules(typ, root, map[reflect.Type]bool{}, &exprs)
+	rules, err := ParseRules(exprs...)
+	if err != nil {
+		return nil, err
+	}
+	tagRulesCache.Store(key, rules)
+	return rules, nil
+}
+
+// MustTagRules is TagRules for rules built at startup. It panics on an invalid root.
+func MustTagRules(root string, v interface{}) Rules {
+	rules, err := TagRules(root, v)
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+func collectTagRules(typ reflect.Type, prefix string, visiting map[reflect.Type]bool, exprs *[]string) {
+	switch typ.Kind() {
+	case reflect.Pointer:
+		collectTagRules(typ.Elem(), prefix, visiting, exprs)
+		return
+	case reflect.Slice, reflect.Array, reflect.Map:
+		collectTagRules(typ.Elem(), prefix+"[*]", visiting, exprs)
+		return
+	case reflect.Struct:
+	default:
+		return
+	}
+	// A recursive type can't be unrolled into paths, so the nested copy is
+	// selected as a whole: encrypting too much is safer than leaking
+	if visiting[typ] {
+		if hasTagRules(typ, map[reflect.Type]bool{}) {
+			*exprs = append(*exprs, prefix)
+		}
+		return
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			// Embedded struct without a json name: its fields are promoted
+			collectTagRules(field.Type, prefix, visiting, exprs)
+			continue
+		}
+		path := prefix + "['" + strings.ReplaceAll(name, "'", `\'`) + "']"
+		if isIdentifier(name) {
+			path = prefix + "." + name
+		}
+		option, _, _ := strings.Cut(field.Tag.Get(TagName), ",")
+		if option == "encrypt" {
+			*exprs = append(*exprs, path)
+			continue
+		}
+		collectTagRules(field.Type, path, visiting, exprs)
+	}
+}
+
+// hasTagRules reports whether typ has any field tagged crypt:"encrypt".
+func hasTagRules(typ reflect.Type, seen map[reflect.Type]bool) bool {
+	switch typ.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return hasTagRules(typ.Elem(), seen)
+	case reflect.Struct:
+	default:
+		return false
+	}
+	if seen[typ] {
+		return false
+	}
+	seen[typ] = true
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if _, ok := jsonName(field); !ok {
+			continue
+		}
+		option, _, _ := strings.Cut(field.Tag.Get(TagName), ",")
+		if option == "encrypt" || hasTagRules(field.Type, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonName returns the name encoding/json uses for field, "" for an embedded
+// struct whose fields are promoted, and false if the field isn't encoded.
+func jsonName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if field.Anonymous && name == "" {
+		typ := field.Type
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		if typ.Kind() == reflect.Struct {
+			return "", true
+		}
+	}
+	if !field.IsExported() {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
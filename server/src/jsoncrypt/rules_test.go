@@ -0,0 +1,218 @@
+package jsoncrypt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func path(steps ...interface{}) Path {
+	p := Path{}
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			p = append(p, Step{Key: s})
+		case int:
+			p = append(p, Step{Index: s, IsIndex: true})
+		}
+	}
+	return p
+}
+
+func TestParseRuleRejects(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"data.email",
+		"$.",
+		"$..",
+		"$.a..",
+		"$[",
+		"$[x]",
+		"$[-1]",
+		"$['a'",
+		"$['a'x]",
+		"$a",
+	} {
+		if _, err := ParseRule(expr); err == nil {
+			t.Errorf("ParseRule(%q) accepted an invalid expression", expr)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	for _, tc := range []struct {
+		rule  string
+		path  Path
+		match bool
+	}{
+		{"$", path(), true},
+		{"$", path("a", 0), true},
+		{"$.data.email", path("data", "email"), true},
+		{"$.data.email", path("data", "name"), false},
+		{"$.data.email", path("data"), false},
+		{"$.data", path("data", "address", "city"), true},
+		{"$['first name']", path("first name"), true},
+		{`$["it\"s"]`, path(`it"s`), true},
+		{"$.items[0].id", path("items", 0, "id"), true},
+		{"$.items[0].id", path("items", 1, "id"), false},
+		{"$.items[0]", path("items", "0"), false},
+		{"$.items[*].id", path("items", 3, "id"), true},
+		{"$.items.*.id", path("items", "x", "id"), true},
+		{"$.items[*].id", path("items", 3, "name"), false},
+		{"$..email", path("email"), true},
+		{"$..email", path("data", "users", 2, "email"), true},
+		{"$..email", path("data", "emails"), false},
+		{"$.data..email", path("other", "email"), false},
+		{"$..users[*].email", path("a", "users", 1, "email"), true},
+	} {
+		rule, err := ParseRule(tc.rule)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", tc.rule, err)
+			continue
+		}
+		if got := rule.Match(tc.path); got != tc.match {
+			t.Errorf("%s matches %s = %t, want %t", tc.rule, tc.path, got, tc.match)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	rules := MustParseRules("$.data.email", "$..token")
+	out, err := Transform([]byte(`{"data":{"email":"a","name":"b","session":{"token":"c"}},"token":"d"}`),
+		Select(rules, func(_ Path, leaf interface{}) (interface{}, error) {
+			return "*", nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"data":{"email":"*","name":"b","session":{"token":"*"}},"token":"*"}` {
+		t.Errorf("Select = %s", out)
+	}
+	if got := rules.String(); got != "[$.data.email $..token]" {
+		t.Errorf("Rules.String() = %q", got)
+	}
+}
+
+type tagAddress struct {
+	City   string `json:"city"`
+	Street string `json:"street" crypt:"encrypt"`
+}
+
+type tagAudit struct {
+	CreatedBy string `json:"created_by" crypt:"encrypt"`
+}
+
+type tagUser struct {
+	tagAudit
+	ID        int                    `json:"id"`
+	Email     string                 `json:"email" crypt:"encrypt"`
+	FirstName string                 `json:"first name" crypt:"encrypt"`
+	Phone     string                 `crypt:"encrypt"`
+	Secret    string                 `json:"-" crypt:"encrypt"`
+	hidden    string                 `crypt:"encrypt"`
+	Address   *tagAddress            `json:"address"`
+	Previous  []tagAddress           `json:"previous"`
+	Contacts  map[string]*tagAddress `json:"contacts"`
+	Tokens    []string               `json:"tokens" crypt:"encrypt"`
+}
+
+type tagNode struct {
+	Name     string     `json:"name" crypt:"encrypt"`
+	Children []*tagNode `json:"children"`
+}
+
+func ruleExprs(rules Rules) []string {
+	exprs := make([]string, len(rules))
+	for i, rule := range rules {
+		exprs[i] = rule.String()
+	}
+	return exprs
+}
+
+func TestTagRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		got  func() (Rules, error)
+		want []string
+	}{
+		{
+			name: "encrypt",
+			got:  func() (Rules, error) { return TagRules("$.data", tagUser{}) },
+			want: []string{
+				"$.data.created_by",
+				"$.data.email",
+				"$.data['first name']",
+				"$.data.Phone",
+				"$.data.address.street",
+				"$.data.previous[*].street",
+				"$.data.contacts[*].street",
+				"$.data.tokens",
+			},
+		},
+		{
+			name: "nil pointer",
+			got:  func() (Rules, error) { return TagRules("$", (*tagAddress)(nil)) },
+			want: []string{"$.street"},
+		},
+		{
+			name: "slice of values",
+			got:  func() (Rules, error) { return TagRules("$.data", []tagAddress{}) },
+			want: []string{"$.data[*].street"},
+		},
+		{
+			name: "recursive type",
+			got:  func() (Rules, error) { return TagRules("$", tagNode{}) },
+			want: []string{"$.name", "$.children[*]"},
+		},
+		{
+			name: "untagged",
+			got:  func() (Rules, error) { return TagRules("$", struct{ Name string }{}) },
+			want: []string{},
+		},
+		{
+			name: "nil",
+			got:  func() (Rules, error) { return TagRules("$", nil) },
+			want: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rules, err := tc.got()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ruleExprs(rules); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("rules = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := TagRules("data", tagUser{}); err == nil {
+		t.Error("TagRules accepted a root without $")
+	}
+}
+
+func TestTagRulesSelectEncodedFields(t *testing.T) {
+	user := tagUser{
+		ID:       1,
+		Email:    "jane@example.com",
+		Address:  &tagAddress{City: "Lagos", Street: "1 Main St"},
+		Previous: []tagAddress{{City: "Abuja", Street: "2 Side St"}},
+		Tokens:   []string{"t1", "t2"},
+	}
+	value, err := ToValue(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var selected []string
+	_, err = Walk(value, Select(MustTagRules("$", user), func(path Path, leaf interface{}) (interface{}, error) {
+		selected = append(selected, path.String())
+		return leaf, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "$.Phone $.address.street $.created_by $.email $['first name'] $.previous[0].street $.tokens[0] $.tokens[1]"
+	if got := strings.Join(selected, " "); got != want {
+		t.Errorf("selected %s, want %s", got, want)
+	}
+}
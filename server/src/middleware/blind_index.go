@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrNoIndexKeys is returned when blind indexes are used without index keys,
+// see KeySet.Index.
+var ErrNoIndexKeys = errors.New("no blind index keys configured")
+
+// BlindIndex computes blind indexes: HMAC-SHA256 of a value under an index
+// key. Equal values give equal indexes, so an encrypted column can be
+// looked up and kept unique through its index, while the index reveals
+// nothing else about the value without the key. Callers normalize values
+// first, e.g. by lower-casing emails.
+type BlindIndex struct {
+	keyring *Keyring
+}
+
+func NewBlindIndex(keyring *Keyring) (*BlindIndex, error) {
+	if keyring == nil {
+		return nil, ErrNoIndexKeys
+	}
+	return &BlindIndex{keyring: keyring}, nil
+}
+
+// Index returns the index of value under the primary index key.
+func (b *BlindIndex) Index(value string) string {
+	return blindIndex(b.keyring.Primary(), value)
+}
+
+// Candidates returns the index of value under every index key, primary
+// first, so rows indexed before a key rotation are still found until they
+// are backfilled.
+func (b *BlindIndex) Candidates(value string) []string {
+	primary := b.keyring.Primary()
+	candidates := []string{blindIndex(primary, value)}
+	for _, key := range b.keyring.Keys() {
+		if key.ID != primary.ID {
+			candidates = append(candidates, blindIndex(key, value))
+		}
+	}
+	return candidates
+}
+
+func blindIndex(key Key, value string) string {
+	mac := hmac.New(sha256.New, key.Material)
+	mac.Write([]byte(value))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// TestBlindIndexKnownAnswer checks the index is HMAC-SHA256 against RFC 4231
+// test case 2.
+func TestBlindIndexKnownAnswer(t *testing.T) {
+	mac, _ := hex.DecodeString("5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843")
+	got := blindIndex(Key{ID: "index-1", Material: []byte("Jefe")}, "what do ya want for nothing?")
+	if want := base64.StdEncoding.EncodeToString(mac); got != want {
+		t.Errorf("blindIndex = %s, want %s", got, want)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	if _, err := NewBlindIndex(nil); !errors.Is(err, ErrNoIndexKeys) {
+		t.Errorf("NewBlindIndex(nil) = %v, want ErrNoIndexKeys", err)
+	}
+
+	keyring := randomKeyring(t, "index-1")
+	index, err := NewBlindIndex(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := index.Index("jane@example.com")
+	if first != index.Index("jane@example.com") {
+		t.Error("Index is not deterministic")
+	}
+	if first == index.Index("Jane@example.com") {
+		t.Error("Index normalized its input, which is the caller's job")
+	}
+
+	// After a rotation new rows use the new key and old rows are still found
+	if err := keyring.Add(randomKey(t, "index-2", KeyActive)); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Promote("index-2"); err != nil {
+		t.Fatal(err)
+	}
+	rotated := index.Index("jane@example.com")
+	if rotated == first {
+		t.Error("Index did not change with the primary key")
+	}
+	candidates := index.Candidates("jane@example.com")
+	if len(candidates) != 2 || candidates[0] != rotated || candidates[1] != first {
+		t.Errorf("Candidates = %q, want the new index then the old one", candidates)
+	}
+
+	m := newTestMiddleware(t, nil)
+	if _, err := m.BlindIndex(); !errors.Is(err, ErrNoIndexKeys) {
+		t.Errorf("BlindIndex without index keys = %v, want ErrNoIndexKeys", err)
+	}
+}
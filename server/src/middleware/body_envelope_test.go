@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestWholeBodyRoundTrip(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, echoJSON)
+
+	sealed, err := m.sealBody([]byte(`{"name":"Jane","age":42}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(r, http.MethodPost, "/api/v1/echo", EncryptedContentType, string(sealed), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); !isEncryptedContentType(got) {
+		t.Errorf("response Content-Type = %q, want %s", got, EncryptedContentType)
+	}
+	plaintext, err := m.openBody(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(plaintext, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data["name"] != "Jane" || response.Data["age"] != float64(42) {
+		t.Errorf("data = %v", response.Data)
+	}
+}
+
+func TestWholeBodyResponseOnAccept(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, echoJSON)
+
+	body := `{"name":"` + mustSeal(t, m.keyring.Primary(), "Jane") + `"}`
+	w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", body, http.Header{"Accept": {EncryptedContentType}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if _, err := m.openBody(w.Body.Bytes()); err != nil {
+		t.Errorf("response is not a whole-body envelope: %v (%s)", err, w.Body)
+	}
+}
+
+func TestOpenBodyRejects(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	sealed, err := m.sealBody([]byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var envelope bodyEnvelope
+	if err := json.Unmarshal(sealed, &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		mutate func(*bodyEnvelope)
+	}{
+		{"version 1", func(e *bodyEnvelope) { e.V = 1 }},
+		{"no kid", func(e *bodyEnvelope) { e.Kid = "" }},
+		{"other suite", func(e *bodyEnvelope) { e.Alg = SuiteChaCha20 }},
+		{"siv", func(e *bodyEnvelope) { e.Alg = SuiteSIV }},
+		{"truncated", func(e *bodyEnvelope) { e.Ct = e.Ct[:len(e.Ct)-4] }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mutated := envelope
+			tc.mutate(&mutated)
+			body, _ := json.Marshal(mutated)
+			if _, err := m.openBody(body); err == nil {
+				t.Error("openBody accepted the envelope")
+			}
+		})
+	}
+}
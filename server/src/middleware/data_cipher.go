@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"errors"
+)
+
+// ErrNoDataKeys is returned when data at rest is encrypted without data keys,
+// see KeySet.Data.
+var ErrNoDataKeys = errors.New("no data encryption keys configured")
+
+// DataCipher encrypts values the server stores, such as database columns,
+// with the data keys. Values are v2 envelopes, so they name the key that
+// sealed them and survive key rotation.
+type DataCipher struct {
+	keyring *Keyring
+}
+
+func NewDataCipher(keyring *Keyring) (*DataCipher, error) {
+	if keyring == nil {
+		return nil, ErrNoDataKeys
+	}
+	return &DataCipher{keyring: keyring}, nil
+}
+
+// Encrypt seals plaintext with AES-256-GCM under the primary data key.
+func (d *DataCipher) Encrypt(plaintext []byte) (string, error) {
+	return sealGCM(d.keyring.Primary(), plaintext)
+}
+
+// EncryptDeterministic seals plaintext with AES-SIV under the primary data
+// key, so equal plaintexts give equal ciphertexts. It is for columns that are
+// queried by value or unique. Values sealed before the primary key changed
+// only match again once they are re-encrypted.
+func (d *DataCipher) EncryptDeterministic(plaintext []byte) (string, error) {
+	return sealEnvelope(SuiteSIV, d.keyring.Primary(), plaintext)
+}
+
+// Decrypt opens a value sealed by either method, with whichever data key it names.
+func (d *DataCipher) Decrypt(ciphertext string) ([]byte, error) {
+	return openDataEnvelope(d.keyring, ciphertext)
+}
+
+// IsEncrypted reports whether value is a well-formed envelope rather than
+// plaintext stored before encryption at rest was turned on.
+func (d *DataCipher) IsEncrypted(value string) bool {
+	return isDataEnvelope(value)
+}
@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDataKeyNotFound = errors.New("data key not found")
+	ErrDataKeyExists   = errors.New("data key already exists")
+)
+
+// DataKey is a data encryption key (DEK) as it is stored: wrapped by the key
+// encryption key (KEK) named by KEKID, which never leaves the KMS.
+type DataKey struct {
+	ID        string
+	KEKID     string
+	Wrapped   []byte
+	CreatedAt time.Time
+	WrappedAt time.Time
+}
+
+// DataKeyStore keeps wrapped data keys. Stores never see a plaintext key.
+type DataKeyStore interface {
+	Get(ctx context.Context, id string) (DataKey, error)
+	// Create fails with ErrDataKeyExists if the ID is taken.
+	Create(ctx context.Context, key DataKey) error
+	// Update replaces a key, e.g. after it is rewrapped.
+	Update(ctx context.Context, key DataKey) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]DataKey, error)
+}
+
+// MemoryDataKeyStore is a DataKeyStore for tests and local development.
+type MemoryDataKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]DataKey
+}
+
+func NewMemoryDataKeyStore() *MemoryDataKeyStore {
+	return &MemoryDataKeyStore{keys: make(map[string]DataKey)}
+}
+
+func (s *MemoryDataKeyStore) Get(_ context.Context, id string) (DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return DataKey{}, fmt.Errorf("%w: %q", ErrDataKeyNotFound, id)
+	}
+	return key, nil
+}
+
+func (s *MemoryDataKeyStore) Create(_ context.Context, key DataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; ok {
+		return fmt.Errorf("%w: %q", ErrDataKeyExists, key.ID)
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *MemoryDataKeyStore) Update(_ context.Context, key DataKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[key.ID]; !ok {
+		return fmt.Errorf("%w: %q", ErrDataKeyNotFound, key.ID)
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *MemoryDataKeyStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *MemoryDataKeyStore) List(_ context.Context) ([]DataKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]DataKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+// DataKeyManager implements envelope encryption: data is encrypted with a
+// data key per record or per tenant, and only the data keys are encrypted
+// with the KEK. Rotating the KEK then means rewrapping the data keys, while
+// the data stays as it is. Destroying a data key makes everything encrypted
+// with it unreadable, which erases a record without touching backups.
+//
+// Ciphertexts are v2 envelopes whose key ID is the data key ID.
+// Unwrapped data keys are cached for the life of the manager.
+type DataKeyManager struct {
+	kms   KMS
+	store DataKeyStore
+
+	mu    sync.RWMutex
+	kekID string
+	cache map[string]Key
+}
+
+// NewDataKeyManager wraps new data keys with the KMS key kekID.
+func NewDataKeyManager(kms KMS, store DataKeyStore, kekID string) *DataKeyManager {
+	return &DataKeyManager{kms: kms, store: store, kekID: kekID, cache: make(map[string]Key)}
+}
+
+// KEKID returns the KMS key new data keys are wrapped with.
+func (m *DataKeyManager) KEKID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.kekID
+}
+
+// Encrypt encrypts plaintext with the data key dataKeyID, e.g. "user-<id>"
+// or "tenant-<id>", creating the key on first use.
+func (m *DataKeyManager) Encrypt(ctx context.Context, dataKeyID string, plaintext []byte) (string, error) {
+	key, err := m.dataKey(ctx, dataKeyID, true)
+	if err != nil {
+		return "", err
+	}
+	return sealGCM(key, plaintext)
+}
+
+// Decrypt decrypts a ciphertext from Encrypt with the data key it names.
+func (m *DataKeyManager) Decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	_, dataKeyID, _, err := parseDataEnvelope(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	key, err := m.dataKey(ctx, dataKeyID, false)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := NewKeyring(key)
+	if err != nil {
+		return nil, err
+	}
+	return openDataEnvelope(keyring, ciphertext)
+}
+
+// Cipher returns a cipher bound to one data key, e.g. a tenant's, with the
+// methods of DataCipher so it can back the encrypted GORM serializers.
+func (m *DataKeyManager) Cipher(ctx context.Context, dataKeyID string) *DataKeyCipher {
+	return &DataKeyCipher{ctx: ctx, manager: m, id: dataKeyID}
+}
+
+// DataKeyCipher encrypts with a single data key of a DataKeyManager.
+type DataKeyCipher struct {
+	ctx      context.Context
+	manager  *DataKeyManager
+	id       string
+	fallback *DataCipher
+}
+
+// WithFallback makes the cipher decrypt values whose key isn't a stored data
+// key with legacy, e.g. rows sealed with the key file's data keys before
+// data keys were moved to a DataKeyStore. Running EncryptColumns then
+// reseals them with the data key.
+func (c *DataKeyCipher) WithFallback(legacy *DataCipher) *DataKeyCipher {
+	return &DataKeyCipher{ctx: c.ctx, manager: c.manager, id: c.id, fallback: legacy}
+}
+
+func (c *DataKeyCipher) Encrypt(plaintext []byte) (string, error) {
+	return c.manager.Encrypt(c.ctx, c.id, plaintext)
+}
+
+// EncryptDeterministic seals plaintext with AES-SIV under the data key, see
+// DataCipher.EncryptDeterministic.
+func (c *DataKeyCipher) EncryptDeterministic(plaintext []byte) (string, error) {
+	key, err := c.manager.dataKey(c.ctx, c.id, true)
+	if err != nil {
+		return "", err
+	}
+	return sealEnvelope(SuiteSIV, key, plaintext)
+}
+
+// Decrypt decrypts with whichever data key the ciphertext names, which need
+// not be this cipher's.
+func (c *DataKeyCipher) Decrypt(ciphertext string) ([]byte, error) {
+	plaintext, err := c.manager.Decrypt(c.ctx, ciphertext)
+	if errors.Is(err, ErrDataKeyNotFound) && c.fallback != nil {
+		return c.fallback.Decrypt(ciphertext)
+	}
+	return plaintext, err
+}
+
+func (c *DataKeyCipher) IsEncrypted(value string) bool {
+	return isDataEnvelope(value)
+}
+
+// Destroy deletes a data key, and with it the only way to decrypt what it
+// encrypted.
+func (m *DataKeyManager) Destroy(ctx context.Context, dataKeyID string) error {
+	if err := m.store.Delete(ctx, dataKeyID); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.cache, dataKeyID)
+	m.mu.Unlock()
+	return nil
+}
+
+// Rewrap makes kekID the KEK for new data keys and rewraps every stored data
+// key that uses another one. The data they encrypt is not touched. Once it
+// returns, the old KEK can be disabled in the KMS. It returns the number of
+// data keys rewrapped; on error, running it again picks up where it stopped.
+func (m *DataKeyManager) Rewrap(ctx context.Context, kekID string) (int, error) {
+	m.mu.Lock()
+	m.kekID = kekID
+	m.mu.Unlock()
+
+	keys, err := m.store.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for _, key := range keys {
+		if key.KEKID == kekID {
+			continue
+		}
+		material, err := m.kms.Decrypt(ctx, key.KEKID, key.Wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to unwrap data key %q: %w", key.ID, err)
+		}
+		wrapped, err := m.kms.Encrypt(ctx, kekID, material)
+		clear(material)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to wrap data key %q: %w", key.ID, err)
+		}
+		key.KEKID, key.Wrapped, key.WrappedAt = kekID, wrapped, time.Now()
+		if err := m.store.Update(ctx, key); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// dataKey returns the unwrapped data key id, creating it if create is set
+// and it doesn't exist yet.
+func (m *DataKeyManager) dataKey(ctx context.Context, id string, create bool) (Key, error) {
+	m.mu.RLock()
+	key, ok := m.cache[id]
+	m.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	stored, err := m.store.Get(ctx, id)
+	if errors.Is(err, ErrDataKeyNotFound) && create {
+		if key, err := m.createDataKey(ctx, id); !errors.Is(err, ErrDataKeyExists) {
+			return key, err
+		}
+		// Someone else created it first
+		stored, err = m.store.Get(ctx, id)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	material, err := m.kms.Decrypt(ctx, stored.KEKID, stored.Wrapped)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to unwrap data key %q: %w", id, err)
+	}
+	return m.remember(Key{ID: id, Material: material, Status: KeyPrimary}), nil
+}
+
+func (m *DataKeyManager) createDataKey(ctx context.Context, id string) (Key, error) {
+	if err := validateKeyID(id); err != nil {
+		return Key{}, err
+	}
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		return Key{}, err
+	}
+	kekID := m.KEKID()
+	wrapped, err := m.kms.Encrypt(ctx, kekID, material)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to wrap data key %q: %w", id, err)
+	}
+	now := time.Now()
+	if err := m.store.Create(ctx, DataKey{ID: id, KEKID: kekID, Wrapped: wrapped, CreatedAt: now, WrappedAt: now}); err != nil {
+		return Key{}, err
+	}
+	return m.remember(Key{ID: id, Material: material, Status: KeyPrimary}), nil
+}
+
+func (m *DataKeyManager) remember(key Key) Key {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cache[key.ID] = key
+	return key
+}
@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func newTestDataKeyManager(t *testing.T, kekIDs ...string) (*DataKeyManager, *FakeKMS, *MemoryDataKeyStore) {
+	t.Helper()
+	kms, err := NewFakeKMS(kekIDs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryDataKeyStore()
+	return NewDataKeyManager(kms, store, kekIDs[0]), kms, store
+}
+
+func TestDataKeyManagerRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	manager, _, store := newTestDataKeyManager(t, "kek-1")
+
+	ciphertext, err := manager.Encrypt(ctx, "user-1", []byte("jane@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get(ctx, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.KEKID != "kek-1" {
+		t.Errorf("data key wrapped with %q, want kek-1", stored.KEKID)
+	}
+
+	// A new manager has nothing cached, so it must unwrap the stored key
+	fresh := NewDataKeyManager(manager.kms, store, "kek-1")
+	plaintext, err := fresh.Decrypt(ctx, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "jane@example.com" {
+		t.Errorf("Decrypt = %q, want jane@example.com", plaintext)
+	}
+}
+
+func TestDataKeyManagerRewrap(t *testing.T) {
+	ctx := context.Background()
+	manager, kms, store := newTestDataKeyManager(t, "kek-1", "kek-2")
+
+	var ciphertexts []string
+	for _, id := range []string{"user-1", "user-2"} {
+		ciphertext, err := manager.Encrypt(ctx, id, []byte(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	before, _ := store.Get(ctx, "user-1")
+
+	rewrapped, err := manager.Rewrap(ctx, "kek-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != 2 {
+		t.Errorf("Rewrap = %d, want 2", rewrapped)
+	}
+	if again, err := manager.Rewrap(ctx, "kek-2"); err != nil || again != 0 {
+		t.Errorf("second Rewrap = %d, %v, want 0, nil", again, err)
+	}
+	after, _ := store.Get(ctx, "user-1")
+	if after.KEKID != "kek-2" || bytes.Equal(after.Wrapped, before.Wrapped) || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("user-1 after Rewrap = %+v, want it wrapped anew with kek-2", after)
+	}
+
+	// The data decrypts once the old KEK is gone
+	kms.removeKey("kek-1")
+	fresh := NewDataKeyManager(kms, store, manager.KEKID())
+	for i, ciphertext := range ciphertexts {
+		if _, err := fresh.Decrypt(ctx, ciphertext); err != nil {
+			t.Errorf("ciphertext %d: %v", i, err)
+		}
+	}
+	if _, err := fresh.Encrypt(ctx, "user-3", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if created, _ := store.Get(ctx, "user-3"); created.KEKID != "kek-2" {
+		t.Errorf("new data key wrapped with %q, want kek-2", created.KEKID)
+	}
+}
+
+func TestDataKeyManagerDestroy(t *testing.T) {
+	ctx := context.Background()
+	manager, _, _ := newTestDataKeyManager(t, "kek-1")
+
+	ciphertext, err := manager.Encrypt(ctx, "user-1", []byte("erase me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Destroy(ctx, "user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Decrypt(ctx, ciphertext); !errors.Is(err, ErrDataKeyNotFound) {
+		t.Errorf("Decrypt after Destroy = %v, want ErrDataKeyNotFound", err)
+	}
+}
+
+func TestDataKeyCipher(t *testing.T) {
+	ctx := context.Background()
+	manager, _, _ := newTestDataKeyManager(t, "kek-1")
+	cipher := manager.Cipher(ctx, "app-data")
+
+	random, err := cipher.Encrypt([]byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := cipher.EncryptDeterministic([]byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := cipher.EncryptDeterministic([]byte("value"))
+	if first != second {
+		t.Errorf("EncryptDeterministic gave %q and %q for the same value", first, second)
+	}
+	for _, ciphertext := range []string{random, first} {
+		if !cipher.IsEncrypted(ciphertext) {
+			t.Errorf("IsEncrypted(%q) = false", ciphertext)
+		}
+		plaintext, err := cipher.Decrypt(ciphertext)
+		if err != nil || string(plaintext) != "value" {
+			t.Errorf("Decrypt(%q) = %q, %v, want value", ciphertext, plaintext, err)
+		}
+	}
+}
+
+func TestDataKeyCipherFallback(t *testing.T) {
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewKeyring(Key{ID: "data-1", Material: material, Status: KeyPrimary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := NewDataCipher(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := legacy.Encrypt([]byte("stored before data keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, _, _ := newTestDataKeyManager(t, "kek-1")
+	cipher := manager.Cipher(context.Background(), "app-data")
+	if _, err := cipher.Decrypt(old); !errors.Is(err, ErrDataKeyNotFound) {
+		t.Errorf("Decrypt without fallback = %v, want ErrDataKeyNotFound", err)
+	}
+	plaintext, err := cipher.WithFallback(legacy).Decrypt(old)
+	if err != nil || string(plaintext) != "stored before data keys" {
+		t.Errorf("Decrypt with fallback = %q, %v", plaintext, err)
+	}
+}
@@ -1,403 +1,870 @@
 package middleware
 
 import (
-        "bytes"
-        "crypto/aes"
-        "crypto/cipher"
-        "encoding/base64"
-        "encoding/json"
-        "fmt"
-        "io"
-        "net/http"
-        "os"
-        "regexp"
-        "github.com/gin-gonic/gin"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Software78/encryption-test/src/jsoncrypt"
+	"github.com/gin-gonic/gin"
 )
 
 type CryptoMiddleware struct {
-        key            []byte
-        iv             []byte // Initialization Vector
-        excludePattern *regexp.Regexp
+	keyring    *Keyring
+	data       *Keyring // keys for data at rest, may be nil
+	index      *Keyring // keys for blind indexes, may be nil
+	master     *Keyring // login session master keys, may be nil
+	hpke       *Keyring // HPKE key pair seeds, may be nil
+	jwe        *Keyring // JWE ECDH-ES key pair seeds, may be nil
+	iv         []byte   // Initialization Vector, only used by ModeCBC
+	mode       Mode
+	suite      Suite // AEAD for ModeGCM envelopes
+	policies   *PolicyRegistry
+	sessions   SessionStore
+	sessionTTL time.Duration
+
+	maxBodyBytes   int64 // limit for bodies that are buffered to be decrypted
+	maxStreamBytes int64 // limit for StreamContentType request bodies
+	segmentSize    int   // plaintext bytes per segment of streamed responses
+
+	nonces          NonceStore
+	signatureWindow time.Duration
+
+	minVersion PayloadVersion
+	strict     bool // only accept the mode's own field format, see withVersion
+
+	encryptedHeaders []string
 }
 
-func NewCryptoMiddlewareFromEnv(excludePattern string) (*CryptoMiddleware, error) {
-        key := os.Getenv("AES_SECRET_KEY")
-        iv := os.Getenv("AES_IV")
+const (
+	DefaultMaxBodyBytes   = 1 << 20
+	DefaultMaxStreamBytes = 1 << 30
+)
+
+// requestEncryptedKey is set on the gin context once a request body has been decrypted.
+const requestEncryptedKey = "cryptoRequestEncrypted"
 
-        if key == "" {
-                return nil, fmt.Errorf("AES_SECRET_KEY environment variable is not set")
-        }
-        if iv == "" {
-                return nil, fmt.Errorf("AES_IV environment variable is not set")
-        }
+// Option configures optional CryptoMiddleware behaviour.
+type Option func(*CryptoMiddleware)
 
-        if len(key) != 32 {
-                return nil, fmt.Errorf("AES_SECRET_KEY must be exactly 32 characters (got %d characters)", len(key))
-        }
+// WithSessionStore sets where handshake session keys are kept and how long they live.
+func WithSessionStore(store SessionStore, ttl time.Duration) Option {
+	return func(m *CryptoMiddleware) {
+		m.sessions = store
+		m.sessionTTL = ttl
+	}
+}
 
-        if len(iv) != 16 {
-                return nil, fmt.Errorf("AES_IV must be exactly 16 characters (got %d characters)", len(iv))
-        }
+// WithPolicies sets the per-route encryption policies. Without it every
+// route uses PolicyRequired.
+func WithPolicies(policies *PolicyRegistry) Option {
+	return func(m *CryptoMiddleware) {
+		m.policies = policies
+	}
+}
 
-        var pattern *regexp.Regexp
-        if excludePattern != "" {
-                _, err := regexp.Compile(excludePattern)
-                if err != nil {
-                        return nil, fmt.Errorf("invalid exclude pattern: %w", err)
-                }
-        }
+// WithBodyLimits caps the size of request bodies. maxBody applies to bodies
+// that are read whole to be decrypted, maxStream to StreamContentType bodies,
+// which are decrypted as the handler reads them. Larger bodies get a 413.
+func WithBodyLimits(maxBody, maxStream int64) Option {
+	return func(m *CryptoMiddleware) {
+		m.maxBodyBytes = maxBody
+		m.maxStreamBytes = maxStream
+	}
+}
+
+// WithStreamSegmentSize sets how much plaintext goes in each segment of a
+// streamed response.
+func WithStreamSegmentSize(size int) Option {
+	return func(m *CryptoMiddleware) {
+		m.segmentSize = size
+	}
+}
 
-        return &CryptoMiddleware{
-                key:            []byte(key), // Convert key to byte slice
-                iv:             []byte(iv),  // Convert IV to byte slice
-                excludePattern: pattern,
-        }, nil
+// WithNonceStore sets where the nonces of signed and HPKE requests are
+// remembered and how far their timestamps may be from the server clock.
+func WithNonceStore(store NonceStore, window time.Duration) Option {
+	return func(m *CryptoMiddleware) {
+		m.nonces = store
+		m.signatureWindow = window
+	}
 }
 
-func (m *CryptoMiddleware) encrypt(plaintext []byte) (string, error) {
-        block, err := aes.NewCipher(m.key)
-        if err != nil {
-                return "", err
-        }
+// WithMinPayloadVersion rejects clients that negotiate an older payload
+// version than min with 426 Upgrade Required.
+func WithMinPayloadVersion(min PayloadVersion) Option {
+	return func(m *CryptoMiddleware) {
+		m.minVersion = min
+	}
+}
 
-        // Pad the plaintext using PKCS7 padding
-    plaintext = pkcs7Pad(plaintext, aes.BlockSize)
+// WithSuite sets the AEAD used for v2 envelopes when the client doesn't ask
+// for one with PayloadCipherHeader.
+func WithSuite(suite Suite) Option {
+	return func(m *CryptoMiddleware) {
+		m.suite = suite
+	}
+}
 
-        ciphertext := make([]byte, len(plaintext))
-        mode := cipher.NewCBCEncrypter(block, m.iv)
-        mode.CryptBlocks(ciphertext, plaintext)
+// WithEncryptedHeaders lists request headers whose values are encrypted like
+// JSON fields. They are decrypted before the handler runs.
+func WithEncryptedHeaders(names ...string) Option {
+	return func(m *CryptoMiddleware) {
+		m.encryptedHeaders = append(m.encryptedHeaders, names...)
+	}
+}
 
-        return base64.StdEncoding.EncodeToString(ciphertext), nil
+// NewCryptoMiddlewareFromEnv builds the middleware with the KeyProvider
+// selected by KEY_PROVIDER and the mode in AES_MODE ("cbc" by default, or "gcm").
+// CRYPTO_MAX_BODY_BYTES and CRYPTO_MAX_STREAM_BYTES override the body limits
+// and CRYPTO_MIN_PAYLOAD_VERSION the minimum payload version.
+// CRYPTO_ENCRYPTED_HEADERS is a comma-separated list of encrypted request
+// headers and CRYPTO_CIPHER_SUITE the default Suite. opts are applied after
+// all of these.
+func NewCryptoMiddlewareFromEnv(opts ...Option) (*CryptoMiddleware, error) {
+	provider, err := NewKeyProviderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	mode, err := ParseMode(os.Getenv("AES_MODE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES_MODE: %w", err)
+	}
+	maxBody, err := sizeFromEnv("CRYPTO_MAX_BODY_BYTES", DefaultMaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxStream, err := sizeFromEnv("CRYPTO_MAX_STREAM_BYTES", DefaultMaxStreamBytes)
+	if err != nil {
+		return nil, err
+	}
+	minVersion := PayloadNone
+	if value := os.Getenv("CRYPTO_MIN_PAYLOAD_VERSION"); value != "" {
+		if minVersion, err = ParsePayloadVersion(value); err != nil {
+			return nil, fmt.Errorf("invalid CRYPTO_MIN_PAYLOAD_VERSION: %w", err)
+		}
+	}
+	var headers []string
+	for _, name := range strings.Split(os.Getenv("CRYPTO_ENCRYPTED_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			headers = append(headers, name)
+		}
+	}
+	suite, err := ParseSuite(os.Getenv("CRYPTO_CIPHER_SUITE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRYPTO_CIPHER_SUITE: %w", err)
+	}
+	opts = append([]Option{
+		WithBodyLimits(maxBody, maxStream),
+		WithSuite(suite),
+		WithMinPayloadVersion(minVersion),
+		WithEncryptedHeaders(headers...),
+	}, opts...)
+	return NewCryptoMiddleware(provider, mode, opts...)
 }
 
-func (m *CryptoMiddleware) decrypt(encrypted string) ([]byte, error) {
-        ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
-        if err != nil {
-                return nil, err
-        }
+func sizeFromEnv(name string, fallback int64) (int64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q is not a positive number of bytes", name, value)
+	}
+	return size, nil
+}
 
-        block, err := aes.NewCipher(m.key)
-        if err != nil {
-                return nil, err
-        }
+func NewCryptoMiddleware(provider KeyProvider, mode Mode, opts ...Option) (*CryptoMiddleware, error) {
+	keys, err := provider.LoadKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
+	}
+	if len(keys.IV) != 16 {
+		return nil, fmt.Errorf("IV must be exactly 16 bytes (got %d bytes)", len(keys.IV))
+	}
+
+	m := &CryptoMiddleware{
+		keyring:    keys.Keyring,
+		data:       keys.Data,
+		index:      keys.Index,
+		master:     keys.Session,
+		hpke:       keys.HPKE,
+		jwe:        keys.JWE,
+		iv:         keys.IV,
+		mode:       mode,
+		suite:      SuiteAESGCM,
+		policies:   NewPolicyRegistry(PolicyRequired),
+		sessions:   NewMemorySessionStore(DefaultSessionCapacity),
+		sessionTTL: DefaultSessionTTL,
+
+		maxBodyBytes:   DefaultMaxBodyBytes,
+		maxStreamBytes: DefaultMaxStreamBytes,
+		segmentSize:    DefaultStreamSegmentSize,
+
+		nonces:          NewMemoryNonceStore(DefaultNonceCapacity),
+		signatureWindow: DefaultSignatureWindow,
+
+		minVersion: PayloadNone,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.maxBodyBytes <= 0 || m.maxStreamBytes <= 0 {
+		return nil, fmt.Errorf("body limits must be positive")
+	}
+	if _, err := ParseSuite(string(m.suite)); err != nil {
+		return nil, err
+	}
+	if _, err := ParsePayloadVersion(string(m.minVersion)); err != nil {
+		return nil, err
+	}
+	if err := m.checkKeyrings(); err != nil {
+		return nil, err
+	}
+	if m.segmentSize <= 0 || m.segmentSize > maxStreamSegmentSize {
+		return nil, fmt.Errorf("stream segment size must be between 1 and %d bytes", maxStreamSegmentSize)
+	}
+	return m, nil
+}
 
-        plaintext := make([]byte, len(ciphertext))
-        mode := cipher.NewCBCDecrypter(block, m.iv)
-        mode.CryptBlocks(plaintext, ciphertext)
+type namedKeyring struct {
+	name    string
+	keyring *Keyring
+}
 
-    plaintext = pkcs7Unpad(plaintext, aes.BlockSize)
+// keyrings returns every configured keyring by purpose.
+func (m *CryptoMiddleware) keyrings() []namedKeyring {
+	var keyrings []namedKeyring
+	for _, keyring := range []namedKeyring{
+		{"transport", m.keyring},
+		{"data", m.data},
+		{"index", m.index},
+		{"session", m.master},
+		{"hpke", m.hpke},
+		{"jwe", m.jwe},
+	} {
+		if keyring.keyring != nil {
+			keyrings = append(keyrings, keyring)
+		}
+	}
+	return keyrings
+}
 
-        return plaintext, nil
+// checkKeyrings runs the entropy check on every key and checks that no two
+// keyrings share a key ID or material. Keys added to a keyring later with
+// Keyring.Add go through the same checks.
+func (m *CryptoMiddleware) checkKeyrings() error {
+	keyrings := m.keyrings()
+	for i, keyring := range keyrings {
+		if err := checkKeyringEntropy(keyring.name, keyring.keyring); err != nil {
+			return err
+		}
+		for _, other := range keyrings[i+1:] {
+			if err := distinctKeys(other.name, other.keyring, keyring.keyring); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, keyring := range keyrings {
+		name := keyring.name
+		var others []*Keyring
+		for j, other := range keyrings {
+			if j != i {
+				others = append(others, other.keyring)
+			}
+		}
+		keyring.keyring.setValidator(func(key Key) error {
+			if err := checkEntropy(key.Material); err != nil {
+				return fmt.Errorf("%s key %q: %w", name, key.ID, err)
+			}
+			single, err := NewKeyring(Key{ID: key.ID, Material: key.Material, Status: KeyPrimary})
+			if err != nil {
+				return err
+			}
+			return distinctKeys(name, single, others...)
+		})
+	}
+	return nil
+}
+
+// distinctKeys checks that no key in keyring reuses the ID or material of a
+// key in others, so each key has a single purpose.
+func distinctKeys(name string, keyring *Keyring, others ...*Keyring) error {
+	if keyring == nil {
+		return nil
+	}
+	for _, key := range keyring.Keys() {
+		for _, other := range others {
+			if other == nil {
+				continue
+			}
+			for _, reused := range other.Keys() {
+				if key.ID == reused.ID || bytes.Equal(key.Material, reused.Material) {
+					return fmt.Errorf("%s key %q must not reuse the key %q", name, key.ID, reused.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// forRequest returns the middleware to use for c: the session-scoped one when
+// the client sent SessionHeader, restricted to the payload version negotiated
+// by DecryptRequestMiddleware if there is one.
+func (m *CryptoMiddleware) forRequest(c *gin.Context) (*CryptoMiddleware, error) {
+	scoped := m
+	if id := c.GetHeader(SessionHeader); id != "" {
+		session, err := m.sessions.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		if scoped, err = m.forSession(session); err != nil {
+			return nil, err
+		}
+		if session.UserID != "" {
+			if err := m.checkSessionUser(session); err != nil {
+				return nil, err
+			}
+			c.Set(sessionUserKey, session.UserID)
+		}
+	}
+	if version, ok := c.Get(payloadVersionKey); ok && version != PayloadNone {
+		scoped = scoped.withVersion(version.(PayloadVersion))
+	}
+	if suite, ok := c.Get(payloadCipherKey); ok {
+		copied := *scoped
+		copied.suite = suite.(Suite)
+		scoped = &copied
+	}
+	return scoped, nil
+}
+
+// Policies returns the per-route encryption policies.
+func (m *CryptoMiddleware) Policies() *PolicyRegistry {
+	return m.policies
+}
+
+// Keyring exposes the middleware's keys so they can be rotated at runtime.
+func (m *CryptoMiddleware) Keyring() *Keyring {
+	return m.keyring
+}
+
+// DataCipher returns the cipher for data at rest, built from the provider's
+// data keys. It fails with ErrNoDataKeys if there are none.
+func (m *CryptoMiddleware) DataCipher() (*DataCipher, error) {
+	return NewDataCipher(m.data)
+}
+
+// BlindIndex returns the blind index built from the provider's index keys.
+// It fails with ErrNoIndexKeys if there are none.
+func (m *CryptoMiddleware) BlindIndex() (*BlindIndex, error) {
+	return NewBlindIndex(m.index)
+}
+
+// encryptLeaf encrypts a single JSON value using the configured mode and the
+// primary key. v2 envelopes carry the JSON encoding of the value, so
+// strings, numbers, booleans and null keep their type. Legacy CBC carries the
+// bare text, as existing clients expect, and leaves null alone.
+func (m *CryptoMiddleware) encryptLeaf(value interface{}) (interface{}, error) {
+	if m.mode == ModeGCM {
+		plaintext, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return sealEnvelope(m.suite, m.keyring.Primary(), plaintext)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return m.encryptCBC([]byte(v))
+	default:
+		return m.encryptCBC([]byte(fmt.Sprintf("%v", v)))
+	}
+}
+
+// decryptLeaf accepts both v2 envelopes, in any transport suite, and legacy CBC ciphertext regardless
+// of the configured mode, so clients can be migrated one at a time. Envelopes
+// may use any key in the ring and decrypt to the original JSON value, with
+// numbers as json.Number. CBC ciphertext carries no key ID or type; it is
+// always decrypted with the primary key and yields a string. Once a client
+// has negotiated a payload version only that version's format is accepted.
+func (m *CryptoMiddleware) decryptLeaf(encrypted string) (interface{}, error) {
+	if m.strict && isEnvelope(encrypted) != (m.mode == ModeGCM) {
+		return nil, fmt.Errorf("value is not in the negotiated %s format", versionForMode(m.mode))
+	}
+	if !isEnvelope(encrypted) {
+		plaintext, err := m.decryptCBC(encrypted)
+		if err != nil {
+			return nil, err
+		}
+		return string(plaintext), nil
+	}
+
+	plaintext, err := openEnvelope(m.keyring, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	value, err := jsoncrypt.Decode(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: payload is not a JSON value", ErrInvalidEnvelope)
+	}
+	return value, nil
+}
+
+func (m *CryptoMiddleware) encryptCBC(plaintext []byte) (string, error) {
+	block, err := aes.NewCipher(m.keyring.Primary().Material)
+	if err != nil {
+		return "", err
+	}
+
+	// Pad the plaintext using PKCS7 padding
+	plaintext = pkcs7Pad(plaintext, aes.BlockSize)
+
+	ciphertext := make([]byte, len(plaintext))
+	mode := cipher.NewCBCEncrypter(block, m.iv)
+	mode.CryptBlocks(ciphertext, plaintext)
+
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (m *CryptoMiddleware) decryptCBC(encrypted string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("ciphertext is not a multiple of the block size")
+	}
+
+	block, err := aes.NewCipher(m.keyring.Primary().Material)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	mode := cipher.NewCBCDecrypter(block, m.iv)
+	mode.CryptBlocks(plaintext, ciphertext)
+
+	plaintext = pkcs7Unpad(plaintext, aes.BlockSize)
+
+	return plaintext, nil
 }
 
 // PKCS7 padding
 func pkcs7Pad(data []byte, blockSize int) []byte {
-    padding := blockSize - len(data)%blockSize
-    padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-    return append(data, padtext...)
+	padding := blockSize - len(data)%blockSize
+	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
+	return append(data, padtext...)
 }
 
 // PKCS7 unpadding
 func pkcs7Unpad(data []byte, blockSize int) []byte {
-    padding := int(data[len(data)-1])
-    if padding > blockSize || padding > len(data) {
-        return data
-    }
-    return data[:len(data)-padding]
+	padding := int(data[len(data)-1])
+	if padding > blockSize || padding > len(data) {
+		return data
+	}
+	return data[:len(data)-padding]
 }
 
+// responseWriter buffers the handler's body so it can be encrypted before
+// anything is sent. Status and headers still go to the wrapped writer, which
+// only sends them once the encrypted body is written.
 type responseWriter struct {
-        gin.ResponseWriter
-        body *bytes.Buffer
+	gin.ResponseWriter
+	body *bytes.Buffer
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
-        return w.body.Write(b)
+	return w.body.Write(b)
 }
 
-func (m *CryptoMiddleware) shouldSkipEncryption(path string) bool {
-        if m.excludePattern == nil {
-                return false
-        }
-        return m.excludePattern.MatchString(path)
+func (w *responseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
 }
 
-// DecryptRequestMiddleware decrypts the request body if it's JSON.
+// DecryptRequestMiddleware decrypts the request body if it's JSON and
+// replaces it with the plaintext, so ShouldBindJSON and its validation
+// work on the real values. What is accepted depends on the route's Policy.
 func (m *CryptoMiddleware) DecryptRequestMiddleware() gin.HandlerFunc {
-        return func(c *gin.Context) {
-                if m.shouldSkipEncryption(c.Request.URL.Path) {
-                        c.Next()
-                        return
-                }
+	return func(c *gin.Context) {
+		policy := m.policies.Lookup(c.Request.URL.Path)
+		if policy.Request == EncryptionDisabled {
+			if isEncryptedRequest(c) {
+				c.Error(NewAppError(http.StatusUnsupportedMediaType,
+					fmt.Sprintf("encryption is disabled for %s", c.Request.URL.Path), nil))
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		cm, err := m.forRequest(c)
+		if err != nil {
+			c.Error(NewAppError(http.StatusUnauthorized, err.Error(), nil))
+			c.Abort()
+			return
+		}
+
+		version, status, err := cm.negotiate(c, policy)
+		if err != nil {
+			c.Error(NewAppError(status, err.Error(), nil))
+			c.Abort()
+			return
+		}
+		if version == PayloadNone {
+			c.Set(payloadVersionKey, version)
+			c.Next()
+			return
+		}
+		// Clients that don't name a version keep getting the lenient legacy behaviour
+		if c.GetHeader(PayloadEncryptionHeader) != "" || c.GetHeader(PayloadCipherHeader) != "" {
+			c.Set(payloadVersionKey, version)
+			cm = cm.withVersion(version)
+		}
+
+		queryEncrypted, err := cm.decryptQuery(c)
+		if err != nil {
+			c.Error(NewAppError(http.StatusBadRequest,
+				fmt.Sprintf("invalid encrypted query for %s: %v", c.Request.URL.Path, err), nil))
+			c.Abort()
+			return
+		}
+		headersEncrypted, err := cm.decryptHeaders(c, policy)
+		if err != nil {
+			c.Error(NewAppError(http.StatusBadRequest,
+				fmt.Sprintf("invalid encrypted header for %s: %v", c.Request.URL.Path, err), nil))
+			c.Abort()
+			return
+		}
+		if queryEncrypted || headersEncrypted {
+			c.Set(requestEncryptedKey, true)
+		}
+
+		// c.ContentType drops the parameters, which hold the plaintext type
+		if ok, plainType := streamContentType(c.GetHeader("Content-Type")); ok {
+			if err := cm.decryptStream(c, plainType); err != nil {
+				c.Error(NewAppError(http.StatusBadRequest,
+					fmt.Sprintf("invalid encrypted stream for %s: %v", c.Request.URL.Path, err), nil))
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		if c.ContentType() == "multipart/form-data" {
+			encrypted, err := cm.decryptMultipart(c, policy)
+			if err != nil {
+				status := http.StatusBadRequest
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				c.Error(NewAppError(status,
+					fmt.Sprintf("invalid encrypted form for %s: %v", c.Request.URL.Path, err), nil))
+				c.Abort()
+				return
+			}
+			if encrypted {
+				c.Set(requestEncryptedKey, true)
+			}
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, m.maxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.Error(NewAppError(http.StatusRequestEntityTooLarge,
+					fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), nil))
+				c.Abort()
+				return
+			}
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+
+		if len(body) > 0 {
+			plaintext, err := cm.decryptBody(c, policy, body)
+			if err != nil && policy.Request == EncryptionOptional && !isEncryptedRequest(c) {
+				// Not encrypted, which this route allows
+				c.Request.Body = io.NopCloser(bytes.NewReader(body))
+				c.Next()
+				return
+			}
+			if err != nil {
+				// Return 400 Bad Request for any decryption failures, except
+				// for replayed HPKE bodies which are refused like signatures
+				status := http.StatusBadRequest
+				switch {
+				case errors.Is(err, ErrNonceReused):
+					status = http.StatusUnauthorized
+				case errors.Is(err, ErrNonceStoreFull):
+					status = http.StatusServiceUnavailable
+				}
+				c.Error(NewAppError(status,
+					fmt.Sprintf("request body must be encrypted for %s: %v", c.Request.URL.Path, err), nil))
+				c.Abort()
+				return
+			}
+			c.Set(requestEncryptedKey, true)
+
+			// Handlers read and bind the plaintext as if it had never been encrypted
+			c.Request.Header.Set("Content-Type", "application/json")
+			c.Request.ContentLength = int64(len(plaintext))
+			c.Request.Body = io.NopCloser(bytes.NewReader(plaintext))
+		}
+
+		c.Next()
+	}
+}
 
-               
+// decryptStream replaces the request body with a reader that decrypts it
+// segment by segment as the handler consumes it. Only the header is read
+// here; a tampered or truncated segment surfaces as ErrInvalidStream from Read.
+func (m *CryptoMiddleware) decryptStream(c *gin.Context, plainType string) error {
+	limited := http.MaxBytesReader(c.Writer, c.Request.Body, m.maxStreamBytes)
+	reader, err := newStreamReader(limited, m.keyring)
+	if err != nil {
+		return err
+	}
+	c.Set(requestEncryptedKey, true)
+	c.Set(streamContextKey, true)
+
+	c.Request.Header.Set("Content-Type", plainType)
+	c.Request.ContentLength = -1
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, limited}
+	return nil
+}
 
-                body, err := io.ReadAll(c.Request.Body)
-                if err != nil {
-                        c.AbortWithStatus(http.StatusBadRequest)
-                        return
-                }
+// decryptBody returns the plaintext JSON for an encrypted request body.
+func (m *CryptoMiddleware) decryptBody(c *gin.Context, policy Policy, body []byte) ([]byte, error) {
+	if isHPKEContentType(c.ContentType()) {
+		plaintext, response, err := m.openHPKERequest(c, body)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(hpkeContextKey, response)
+		return plaintext, nil
+	}
+	if ok, jsonSerialization := joseContentType(c.ContentType()); ok {
+		plaintext, response, err := m.openJWE(body, jsonSerialization)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(jweContextKey, response)
+		return plaintext, nil
+	}
+	if requestBodyMode(c, policy) == BodyWhole {
+		c.Set(bodyModeKey, string(BodyWhole))
+		return m.openBody(body)
+	}
+
+	return m.decryptJSON(body)
+}
 
-                if len(body) > 0 {
-                        decryptedData, err := m.decryptJSON(body)
-                        if err != nil {
-                                // Return 400 Bad Request for any decryption failures
-                                c.AbortWithError(http.StatusBadRequest, 
-                                        fmt.Errorf("failed to decrypt request body: %v", err))
-                                return
-                        }
+// EncryptResponseMiddleware encrypts JSON response bodies. For a
+// models.SuccessResponse only "data" is encrypted, whatever its type, so
+// clients can still read "code" and "success"; routes whose Policy lists
+// Fields only get those values encrypted. Error responses and non-JSON
+// bodies are sent as they are. Routes with an optional response policy are
+// only encrypted when the request was.
+func (m *CryptoMiddleware) EncryptResponseMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := m.policies.Lookup(c.Request.URL.Path)
+		if policy.Response == EncryptionDisabled {
+			c.Next()
+			return
+		}
+
+		cm, err := m.forRequest(c)
+		if err != nil {
+			c.Error(NewAppError(http.StatusUnauthorized, err.Error(), nil))
+			c.Abort()
+			return
+		}
+		if version, ok := c.Get(payloadVersionKey); ok && version.(PayloadVersion) == PayloadNone {
+			c.Next()
+			return
+		}
+
+		if wantsStreamResponse(c) {
+			cm.streamResponse(c)
+			return
+		}
+
+		// Capture Response Body
+		writer := &responseWriter{
+			ResponseWriter: c.Writer,
+			body:           &bytes.Buffer{},
+		}
+		c.Writer = writer
+
+		c.Next() // Let the handler process the request
+
+		// Restore the real writer so outer middleware (e.g. ErrorHandler) can still respond
+		c.Writer = writer.ResponseWriter
+		if writer.body.Len() == 0 {
+			return
+		}
+		if policy.Response == EncryptionOptional && !c.GetBool(requestEncryptedKey) {
+			c.Writer.Write(writer.body.Bytes())
+			return
+		}
+
+		body, contentType, err := cm.encryptResponse(c, policy, writer.body.Bytes())
+		if err != nil {
+			c.Error(fmt.Errorf("failed to encrypt response body: %w", err))
+			return
+		}
+
+		c.Writer.Header().Del("Content-Length")
+		c.Header("Content-Type", contentType)
+		c.Writer.Write(body)
+	}
+}
 
-                        c.Set("decryptedJSON", decryptedData)
-                        c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
-                }
+// streamResponse encrypts the handler's output as it is written, so the
+// response is never held in memory. Streamed responses are encrypted whatever
+// their content type, since the client asked for StreamContentType.
+func (m *CryptoMiddleware) streamResponse(c *gin.Context) {
+	writer := &streamResponseWriter{
+		ResponseWriter: c.Writer,
+		key:            m.keyring.Primary(),
+		segmentSize:    m.segmentSize,
+	}
+	c.Writer = writer
+
+	c.Next()
+
+	c.Writer = writer.ResponseWriter
+	if err := writer.Close(); err != nil {
+		// Headers are already sent; the client sees a truncated stream
+		c.Error(fmt.Errorf("failed to finish encrypted stream: %w", err))
+	}
+}
 
-                c.Next()
-        }
+// encryptResponse returns the encrypted body and its content type.
+func (m *CryptoMiddleware) encryptResponse(c *gin.Context, policy Policy, body []byte) ([]byte, string, error) {
+	contentType := c.Writer.Header().Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" || c.Writer.Status() >= http.StatusBadRequest {
+		return body, contentType, nil
+	}
+
+	if response, ok := c.Get(hpkeContextKey); ok {
+		c.Header(PayloadEncryptionHeader, string(PayloadV2))
+		sealed, err := sealHPKE(response.(*hpkeResponse), body)
+		return sealed, HPKEContentType, err
+	}
+	if response, ok := m.jweResponseFor(c); ok {
+		c.Header(PayloadEncryptionHeader, string(PayloadV2))
+		sealed, err := sealJWE(response, body)
+		return sealed, response.contentType(), err
+	}
+	if responseBodyMode(c, policy) == BodyWhole {
+		c.Header(PayloadEncryptionHeader, string(PayloadV2))
+		c.Header(PayloadCipherHeader, string(m.suite))
+		sealed, err := m.sealBody(body)
+		return sealed, EncryptedContentType, err
+	}
+	c.Header(PayloadEncryptionHeader, string(versionForMode(m.mode)))
+	if m.mode == ModeGCM {
+		c.Header(PayloadCipherHeader, string(m.suite))
+	}
+
+	value, err := jsoncrypt.Decode(body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to unmarshal response body: %w", err)
+	}
+
+	fields := policy.Fields
+	if len(fields) == 0 {
+		fields = allFields
+		if response, ok := value.(map[string]interface{}); ok && isSuccessResponse(response) {
+			fields = dataFields
+		}
+	}
+	value, err = jsoncrypt.Walk(value, m.fieldEncrypter(fields))
+	if err != nil {
+		return nil, "", err
+	}
+
+	encrypted, err := json.Marshal(value)
+	return encrypted, "application/json; charset=utf-8", err
 }
 
-func (m *CryptoMiddleware) EncryptResponseMiddleware() gin.HandlerFunc {
-        return func(c *gin.Context) {
-                // Capture Response Body
-                writer := &responseWriter{
-                        ResponseWriter: c.Writer,
-                        body:          &bytes.Buffer{},
-                }
-                c.Writer = writer
-
-                c.Next() // Let the handler process the request
-
-                if writer.body.Len() > 0 {
-                        // Unmarshal the data from the handler
-                        responseData := make(map[string]interface{})
-                        err := json.Unmarshal(writer.body.Bytes(), &responseData)
-                        if err != nil {
-                                c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("failed to unmarshal response body: %w", err))
-                                return
-                        }
-
-                        encryptedData, err := m.encryptJSON(writer.body.Bytes()) // Encrypt!
-                        if err != nil {
-                                c.AbortWithError(http.StatusInternalServerError, err)
-                                return
-                        }
-
-                        encryptedJSON, err := json.Marshal(encryptedData)
-                        if err != nil {
-                                c.AbortWithError(http.StatusInternalServerError, err)
-                                return
-                        }
-
-                        c.Header("Content-Type", "application/json")
-                        c.Writer.Write(encryptedJSON) // Write the encrypted JSON
-                }
-        }
-}
-
-func (m *CryptoMiddleware) encryptJSON(data []byte) (map[string]interface{}, error) {
-        var jsonData map[string]interface{}
-        err := json.Unmarshal(data, &jsonData)
-        if err != nil {
-                return nil, err
-        }
-
-        for key, value := range jsonData {
-                switch v := value.(type) {
-                case string:
-                        processedValue, err := m.encrypt([]byte(v))
-                        if err != nil {
-                                return nil, fmt.Errorf("error encrypting field %s: %w", key, err)
-                        }
-                        jsonData[key] = processedValue
-
-                case map[string]interface{}:
-                        nestedJSON, err := json.Marshal(v)
-                        if err != nil {
-                                return nil, err
-                        }
-                        processedNestedData, err := m.encryptJSON(nestedJSON)
-                        if err != nil {
-                                return nil, err
-                        }
-                        jsonData[key] = processedNestedData
-
-                case []interface{}:
-                        for i, item := range v {
-                                itemJSON, err := json.Marshal(item)
-                                if err != nil {
-                                        return nil, err
-                                }
-                                processedItem, err := m.encryptJSON(itemJSON)
-                                if err != nil {
-                                        return nil, err
-                                }
-                                v[i] = processedItem
-                        }
-                        jsonData[key] = v
-
-                default:
-                        processedValue, err := m.encrypt([]byte(fmt.Sprintf("%v", v)))
-                        if err != nil {
-                                return nil, fmt.Errorf("error encrypting field %s: %w", key, err)
-                        }
-                        jsonData[key] = processedValue
-                }
-        }
-
-        return jsonData, nil
-}
-
-func (m *CryptoMiddleware) decryptJSON(data []byte) (map[string]interface{}, error) {
-        var jsonData map[string]interface{}
-        err := json.Unmarshal(data, &jsonData)
-        if err != nil {
-                return nil, fmt.Errorf("invalid JSON format: %v", err)
-        }
-
-        for key, value := range jsonData {
-                switch v := value.(type) {
-                case string:
-                        decryptedBytes, err := m.decrypt(v)
-                        if err != nil {
-                                return nil, fmt.Errorf("failed to decrypt field '%s': %v", key, err)
-                        }
-                        
-                        // Handle JSON string values (wrapped in quotes)
-                        if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
-                                var decryptedValue interface{}
-                                err = json.Unmarshal(decryptedBytes, &decryptedValue)
-                                if err != nil {
-                                        return nil, fmt.Errorf("invalid JSON in decrypted value for field '%s': %v", key, err)
-                                }
-                                jsonData[key] = decryptedValue
-                        } else {
-                                jsonData[key] = string(decryptedBytes)
-                        }
-
-                case map[string]interface{}:
-                        nestedJSON, err := json.Marshal(v)
-                        if err != nil {
-                                return nil, fmt.Errorf("failed to marshal nested object in field '%s': %v", key, err)
-                        }
-                        processedNestedData, err := m.decryptJSON(nestedJSON)
-                        if err != nil {
-                                return nil, err
-                        }
-                        jsonData[key] = processedNestedData
-
-                case []interface{}:
-                        for i, item := range v {
-                                itemJSON, err := json.Marshal(item)
-                                if err != nil {
-                                        return nil, fmt.Errorf("failed to marshal array item %d in field '%s': %v", i, key, err)
-                                }
-                                processedItem, err := m.decryptJSON(itemJSON)
-                                if err != nil {
-                                        return nil, err
-                                }
-                                v[i] = processedItem
-                        }
-                        jsonData[key] = v
-
-                default:
-                        // For non-string primitive values (numbers, booleans, null), keep as is
-                }
-        }
-
-        return jsonData, nil
+var (
+	allFields  = jsoncrypt.MustParseRules("$")
+	dataFields = jsoncrypt.MustParseRules("$.data")
+)
+
+// isSuccessResponse reports whether a decoded body has the shape of models.SuccessResponse.
+func isSuccessResponse(body map[string]interface{}) bool {
+	_, hasData := body["data"]
+	_, hasSuccess := body["success"].(bool)
+	return hasData && hasSuccess
 }
 
+// decryptJSON decrypts every string leaf of a JSON document of any shape and
+// returns the plaintext document. Other leaves were never encrypted and are
+// kept as they are.
+func (m *CryptoMiddleware) decryptJSON(data []byte) ([]byte, error) {
+	return jsoncrypt.Transform(data, func(_ jsoncrypt.Path, leaf interface{}) (interface{}, error) {
+		encrypted, ok := leaf.(string)
+		if !ok {
+			return leaf, nil
+		}
+		return m.decryptLeaf(encrypted)
+	})
+}
 
+// fieldEncrypter returns a visitor that encrypts the leaves selected by fields.
+func (m *CryptoMiddleware) fieldEncrypter(fields jsoncrypt.Rules) jsoncrypt.Visitor {
+	return jsoncrypt.Select(fields, func(_ jsoncrypt.Path, leaf interface{}) (interface{}, error) {
+		return m.encryptLeaf(leaf)
+	})
+}
 
+// EncryptValues returns the JSON encoding of data with its sensitive values
+// encrypted. If data's type tags fields with crypt:"encrypt" only those are
+// encrypted, otherwise every leaf is.
 func (m *CryptoMiddleware) EncryptValues(data interface{}) ([]byte, error) {
-        // 1. Marshal the interface to JSON (to handle different data structures)
-        jsonData, err := json.Marshal(data)
-        if err != nil {
-                return nil, fmt.Errorf("failed to marshal interface to JSON: %w", err)
-        }
-
-        // 2. Unmarshal the JSON into a map[string]interface{}
-        var dataMap map[string]interface{}
-        err = json.Unmarshal(jsonData, &dataMap)
-        if err != nil {
-                return nil, fmt.Errorf("failed to unmarshal JSON to map: %w", err)
-        }
-
-
-        // 3. Encrypt only the values in the map
-        encryptedMap, err := m.encryptMapValues(dataMap) // Helper function (see below)
-        if err != nil {
-                return nil, err
-        }
-
-        // 4. Marshal the map back to JSON
-        encryptedJSON, err := json.Marshal(encryptedMap)
-        if err != nil {
-                return nil, fmt.Errorf("failed to marshal encrypted map to JSON: %w", err)
-        }
-        fmt.Println(string(encryptedJSON))
-
-        return encryptedJSON, nil
-}
-
-func (m *CryptoMiddleware) encryptMapValues(dataMap map[string]interface{}) (map[string]interface{}, error) {
-    encryptedMap := make(map[string]interface{})
-    for key, value := range dataMap {
-        switch v := value.(type) {
-        case string:
-            encryptedValue, err := m.encrypt([]byte(v))
-            if err != nil {
-                return nil, fmt.Errorf("error encrypting field %s: %w", key, err)
-            }
-            encryptedMap[key] = encryptedValue // Encrypt string value
-
-        case map[string]interface{}: // Handle nested maps
-            nestedEncryptedMap, err := m.encryptMapValues(v)
-            if err != nil {
-                return nil, err
-            }
-            encryptedMap[key] = nestedEncryptedMap
-
-        case []interface{}: // Handle arrays
-            encryptedArray := make([]interface{}, len(v))
-            for i, item := range v {
-                itemJSON, err := json.Marshal(item)
-                if err != nil {
-                    return nil, err
-                }
-                var itemMap map[string]interface{}
-                err = json.Unmarshal(itemJSON, &itemMap)
-                if err != nil {
-                    // If not a map (e.g., string), encrypt directly
-                    itemString, ok := item.(string)
-                    if ok {
-                        encryptedItem, err := m.encrypt([]byte(itemString))
-                        if err != nil {
-                            return nil, fmt.Errorf("error encrypting array item %d: %w", i, err)
-                        }
-                        encryptedArray[i] = encryptedItem
-                    } else {
-                        encryptedArray[i] = item // Keep non-string array items as they are
-                    }
-                    continue
-                }
-                encryptedItem, err := m.encryptMapValues(itemMap)
-                if err != nil {
-                    return nil, err
-                }
-                encryptedArray[i] = encryptedItem
-            }
-            encryptedMap[key] = encryptedArray
-
-        default:
-            // For other types (numbers, booleans, etc.), encrypt if needed
-            // Or keep them as they are if no encryption is required
-            strValue := fmt.Sprintf("%v", v)
-            encryptedValue, err := m.encrypt([]byte(strValue))
-            if err != nil {
-                return nil, fmt.Errorf("error encrypting field %s: %w", key, err)
-            }
-            encryptedMap[key] = encryptedValue
-        }
-    }
-    return encryptedMap, nil
-}
\ No newline at end of file
+	rules, err := jsoncrypt.TagRules("$", data)
+	if err != nil {
+		return nil, err
+	}
+	value, err := jsoncrypt.ToValue(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert value to JSON: %w", err)
+	}
+
+	if len(rules) == 0 {
+		rules = allFields
+	}
+	value, err = jsoncrypt.Walk(value, m.fieldEncrypter(rules))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
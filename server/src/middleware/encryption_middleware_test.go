@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestEncryptResponseSuccessData(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{"name": "Jane", "tags": []string{"a"}}})
+	})
+	w := serve(r, http.MethodGet, "/api/v1/users", "", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get(PayloadEncryptionHeader); got != string(PayloadV2) {
+		t.Errorf("%s = %q, want v2", PayloadEncryptionHeader, got)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body["code"] != float64(http.StatusOK) || body["success"] != true {
+		t.Errorf("code and success must stay readable: %s", w.Body)
+	}
+	data := body["data"].(map[string]interface{})
+	if got := mustOpen(t, m.keyring, data["name"]); got != "Jane" {
+		t.Errorf("name = %v", got)
+	}
+	if got := mustOpen(t, m.keyring, data["tags"].([]interface{})[0]); got != "a" {
+		t.Errorf("tags[0] = %v", got)
+	}
+}
+
+func TestEncryptResponseLeavesErrorsAndOtherTypes(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, func(c *gin.Context) {
+		switch c.Param("path") {
+		case "/error":
+			c.JSON(http.StatusNotFound, gin.H{"code": http.StatusNotFound, "message": "not found"})
+		case "/text":
+			c.String(http.StatusOK, "plain text")
+		}
+	})
+
+	w := serve(r, http.MethodGet, "/error", "", "", nil)
+	if w.Code != http.StatusNotFound || w.Body.String() != `{"code":404,"message":"not found"}` {
+		t.Errorf("error response = %d %s, want it as the handler wrote it", w.Code, w.Body)
+	}
+	w = serve(r, http.MethodGet, "/text", "", "", nil)
+	if w.Body.String() != "plain text" {
+		t.Errorf("text response = %s, want it as the handler wrote it", w.Body)
+	}
+}
+
+type bindTarget struct {
+	Email string `json:"email" binding:"required,email"`
+	Age   int    `json:"age" binding:"min=18"`
+}
+
+func TestDecryptedBodyIsBound(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, func(c *gin.Context) {
+		var target bindTarget
+		if err := c.ShouldBindJSON(&target); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": target.Age})
+	})
+	key := m.keyring.Primary()
+
+	body := `{"email":"` + mustSeal(t, key, "jane@example.com") + `","age":"` + mustSeal(t, key, 42) + `"}`
+	w := serve(r, http.MethodPost, "/api/v1/users", "application/json", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got := mustOpen(t, m.keyring, responseData(t, w)); got != float64(42) {
+		t.Errorf("bound age = %v, want 42", got)
+	}
+
+	// Validation sees the plaintext, not the envelope
+	body = `{"email":"` + mustSeal(t, key, "not an email") + `","age":"` + mustSeal(t, key, 42) + `"}`
+	w = serve(r, http.MethodPost, "/api/v1/users", "application/json", body, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid plaintext email: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
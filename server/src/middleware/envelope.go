@@ -0,0 +1,177 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Mode selects the cipher used when encrypting values.
+type Mode string
+
+const (
+	// ModeCBC is the legacy AES-CBC mode with a static IV, kept for existing clients.
+	ModeCBC Mode = "cbc"
+	// ModeGCM is an AEAD with a random nonce per value, wrapped in a versioned
+	// envelope. The AEAD is AES-256-GCM unless another Suite is configured.
+	ModeGCM Mode = "gcm"
+)
+
+// envelopePrefixV2 marks an AEAD envelope of the form "v2:<kid>:<base64>"
+// (AES-GCM) or "v2:<suite>:<kid>:<base64>".
+// Legacy CBC ciphertext is plain standard base64, which never contains a
+// colon, so the two can be told apart.
+const envelopePrefixV2 = "v2:"
+
+var ErrInvalidEnvelope = errors.New("invalid encryption envelope")
+
+func ParseMode(s string) (Mode, error) {
+	switch Mode(strings.ToLower(s)) {
+	case "", ModeCBC:
+		return ModeCBC, nil
+	case ModeGCM:
+		return ModeGCM, nil
+	default:
+		return "", fmt.Errorf("unknown encryption mode %q", s)
+	}
+}
+
+// isEnvelope reports whether encrypted is a versioned envelope rather than legacy CBC ciphertext.
+func isEnvelope(encrypted string) bool {
+	return strings.HasPrefix(encrypted, envelopePrefixV2)
+}
+
+// envelopeHeader is the part of an envelope bound as associated data:
+// "v2:<kid>:" for AES-GCM, which keeps the original format, and
+// "v2:<suite>:<kid>:" for every other suite.
+func envelopeHeader(suite Suite, kid string) string {
+	if suite == SuiteAESGCM {
+		return envelopePrefixV2 + kid + ":"
+	}
+	return envelopePrefixV2 + string(suite) + ":" + kid + ":"
+}
+
+// sealEnvelope encrypts plaintext with a fresh random nonce and returns the
+// envelope header + base64(nonce || ciphertext || tag). SuiteSIV has no
+// nonce, so its envelopes are deterministic. The header is bound
+// to the ciphertext as associated data so the suite and kid cannot be swapped.
+func sealEnvelope(suite Suite, key Key, plaintext []byte) (string, error) {
+	aead, err := newAEAD(suite, key.Material)
+	if err != nil {
+		return "", err
+	}
+
+	header := envelopeHeader(suite, key.ID)
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(header))
+
+	return header + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// sealGCM seals an AES-256-GCM envelope, for data the server keeps to itself.
+func sealGCM(key Key, plaintext []byte) (string, error) {
+	return sealEnvelope(SuiteAESGCM, key, plaintext)
+}
+
+// openEnvelope verifies and decrypts a transport envelope produced by
+// sealEnvelope, with the suite it names and whichever key in the ring it names.
+func openEnvelope(keyring *Keyring, envelope string) ([]byte, error) {
+	suite, kid, payload, err := parseEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return openParsedEnvelope(keyring, envelope, suite, kid, payload)
+}
+
+// isDataEnvelope reports whether value is a well-formed data envelope: a
+// known suite, a key ID and a base64 payload long enough for a nonce and tag.
+// Plaintext stored before encryption at rest may itself start with "v2:".
+func isDataEnvelope(value string) bool {
+	suite, kid, payload, err := parseDataEnvelope(value)
+	if err != nil || kid == "" {
+		return false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	return err == nil && len(sealed) >= sealedOverhead(suite)
+}
+
+// openDataEnvelope is openEnvelope for data at rest, which may also be SuiteSIV.
+func openDataEnvelope(keyring *Keyring, envelope string) ([]byte, error) {
+	suite, kid, payload, err := parseDataEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return openParsedEnvelope(keyring, envelope, suite, kid, payload)
+}
+
+func openParsedEnvelope(keyring *Keyring, envelope string, suite Suite, kid, payload string) ([]byte, error) {
+	key, err := keyring.Lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+
+	aead, err := newAEAD(suite, key.Material)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidEnvelope)
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	header := envelope[:len(envelope)-len(payload)]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(header))
+	if err != nil {
+		return nil, fmt.Errorf("%w: authentication failed", ErrInvalidEnvelope)
+	}
+	return plaintext, nil
+}
+
+// parseEnvelope splits a transport envelope into the suite, key ID and base64
+// payload. It accepts the suites ParseSuite does, so never SuiteSIV.
+func parseEnvelope(envelope string) (suite Suite, kid, payload string, err error) {
+	return splitEnvelope(envelope, ParseSuite)
+}
+
+// parseDataEnvelope is parseEnvelope for data at rest, see parseDataSuite.
+func parseDataEnvelope(envelope string) (suite Suite, kid, payload string, err error) {
+	return splitEnvelope(envelope, parseDataSuite)
+}
+
+func splitEnvelope(envelope string, parseSuite func(string) (Suite, error)) (suite Suite, kid, payload string, err error) {
+	if !isEnvelope(envelope) {
+		return "", "", "", ErrInvalidEnvelope
+	}
+	// Base64 has no colons, so the segment count tells the two formats apart
+	parts := strings.Split(strings.TrimPrefix(envelope, envelopePrefixV2), ":")
+	switch len(parts) {
+	case 2:
+		return SuiteAESGCM, parts[0], parts[1], nil
+	case 3:
+		if suite, err = parseSuite(parts[0]); err != nil {
+			return "", "", "", fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+		}
+		return suite, parts[1], parts[2], nil
+	default:
+		return "", "", "", fmt.Errorf("%w: missing key id", ErrInvalidEnvelope)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
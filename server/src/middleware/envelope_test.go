@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSealEnvelopeRoundTrip(t *testing.T) {
+	keyring := randomKeyring(t, "key-1")
+	first, err := sealGCM(keyring.Primary(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sealGCM(keyring.Primary(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "v2:key-1:") {
+		t.Errorf("envelope %q does not start with v2:key-1:", first)
+	}
+	if first == second {
+		t.Error("sealing twice gave the same envelope, so the nonce is not random")
+	}
+	for _, envelope := range []string{first, second} {
+		plaintext, err := openEnvelope(keyring, envelope)
+		if err != nil || string(plaintext) != "secret" {
+			t.Errorf("openEnvelope(%q) = %q, %v", envelope, plaintext, err)
+		}
+	}
+}
+
+func TestOpenEnvelopeRejectsTampering(t *testing.T) {
+	keyring := randomKeyring(t, "key-1", "key-2")
+	envelope, err := sealGCM(keyring.Primary(), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.TrimPrefix(envelope, "v2:key-1:")
+	sealed, _ := base64.StdEncoding.DecodeString(payload)
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)-1] ^= 1
+
+	for _, tc := range []struct {
+		name     string
+		envelope string
+		want     error
+	}{
+		{"flipped tag bit", "v2:key-1:" + base64.StdEncoding.EncodeToString(flipped), ErrInvalidEnvelope},
+		{"other key id", "v2:key-2:" + payload, ErrInvalidEnvelope},
+		{"unknown key id", "v2:key-3:" + payload, ErrUnknownKey},
+		{"too short", "v2:key-1:" + base64.StdEncoding.EncodeToString(sealed[:12]), ErrInvalidEnvelope},
+		{"bad base64", "v2:key-1:%%%", ErrInvalidEnvelope},
+		{"no key id", "v2:" + payload, ErrInvalidEnvelope},
+		{"not an envelope", payload, ErrInvalidEnvelope},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := openEnvelope(keyring, tc.envelope); !errors.Is(err, tc.want) {
+				t.Errorf("openEnvelope = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLeafEncryptionGCM(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	encrypted, err := m.encryptLeaf("jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEnvelope(encrypted.(string)) {
+		t.Fatalf("encryptLeaf = %q, want a v2 envelope", encrypted)
+	}
+	value, err := m.decryptLeaf(encrypted.(string))
+	if err != nil || value != "jane@example.com" {
+		t.Errorf("decryptLeaf = %v, %v", value, err)
+	}
+}
+
+func TestLeafEncryptionAcceptsLegacyCBC(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	legacy, err := m.encryptCBC([]byte("from an old client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEnvelope(legacy) {
+		t.Fatalf("CBC ciphertext %q looks like an envelope", legacy)
+	}
+	value, err := m.decryptLeaf(legacy)
+	if err != nil || value != "from an old client" {
+		t.Errorf("decryptLeaf(CBC) = %v, %v", value, err)
+	}
+}
+
+func TestLeafEncryptionPreservesTypes(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, func(c *gin.Context) {
+		var target struct {
+			Age   int     `json:"age"`
+			Admin bool    `json:"admin"`
+			Note  *string `json:"note"`
+			Name  string  `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&target); err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{
+			"age": target.Age, "admin": target.Admin, "note": target.Note, "name": target.Name,
+		}})
+	})
+	key := m.keyring.Primary()
+	body := `{"age":"` + mustSeal(t, key, 42) + `","admin":"` + mustSeal(t, key, true) +
+		`","note":"` + mustSeal(t, key, nil) + `","name":"` + mustSeal(t, key, "42") + `"}`
+
+	w := serve(r, http.MethodPost, "/api/v1/users", "application/json", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	data := responseData(t, w).(map[string]interface{})
+	for name, want := range map[string]interface{}{"age": float64(42), "admin": true, "note": nil, "name": "42"} {
+		if got := mustOpen(t, m.keyring, data[name]); got != want {
+			t.Errorf("%s = %#v, want %#v", name, got, want)
+		}
+	}
+}
+
+func TestTransportRejectsSIV(t *testing.T) {
+	keyring := randomKeyring(t, "key-1")
+	envelope, err := sealEnvelope(SuiteSIV, keyring.Primary(), []byte(`"jane@example.com"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openEnvelope(keyring, envelope); !errors.Is(err, ErrInvalidEnvelope) {
+		t.Errorf("openEnvelope(siv) = %v, want ErrInvalidEnvelope", err)
+	}
+	if _, err := ParseSuite("siv"); err == nil {
+		t.Error("ParseSuite accepted siv")
+	}
+	if plaintext, err := openDataEnvelope(keyring, envelope); err != nil || string(plaintext) != `"jane@example.com"` {
+		t.Errorf("openDataEnvelope(siv) = %q, %v", plaintext, err)
+	}
+}
+
+func TestIsDataEnvelope(t *testing.T) {
+	keyring := randomKeyring(t, "data-1")
+	for _, suite := range []Suite{SuiteAESGCM, SuiteChaCha20, SuiteXChaCha20, SuiteSIV} {
+		// The empty plaintext gives the shortest envelope of each suite
+		envelope, err := sealEnvelope(suite, keyring.Primary(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isDataEnvelope(envelope) {
+			t.Errorf("isDataEnvelope(%q) = false", envelope)
+		}
+	}
+
+	// Plaintext stored before encryption at rest that happens to start with v2:
+	for _, plaintext := range []string{
+		"v2:",
+		"v2: see the attached notes",
+		"v2:data-1:not base64!",
+		"v2:data-1:QUJD",
+		"v2::AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA==",
+		"v2:rot13:data-1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA==",
+		"v2:a:b:c:d",
+	} {
+		if isDataEnvelope(plaintext) {
+			t.Errorf("isDataEnvelope(%q) = true", plaintext)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package middleware
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 
 	"github.com/Software78/encryption-test/src/models"
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
@@ -60,6 +62,14 @@ func handleErrors(c *gin.Context) {
 			appError = err
 		case *ValidationError:
 			validationErrors = append(validationErrors, *err)
+		case validator.ValidationErrors:
+			// Binding failures from ShouldBindJSON
+			for _, fieldErr := range err {
+				validationErrors = append(validationErrors, ValidationError{
+					Field:   fieldErr.Field(),
+					Message: fieldErr.Error(),
+				})
+			}
 		default:
 			primaryError = e.Err
 		}
@@ -82,7 +92,16 @@ func handleErrors(c *gin.Context) {
 
 	case primaryError != nil:
 		// Handle specific known error types
+		var tooLarge *http.MaxBytesError
 		switch {
+		case errors.As(primaryError, &tooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit),
+			})
+		case errors.Is(primaryError, ErrInvalidStream):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid encrypted stream",
+			})
 		case errors.Is(primaryError, gorm.ErrRecordNotFound):
 			c.JSON(http.StatusNotFound, gin.H{
 				"error": "Resource Not Found",
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staticKeyProvider hands NewCryptoMiddleware a KeySet built by a test.
+type staticKeyProvider struct {
+	keys *KeySet
+}
+
+func (p staticKeyProvider) LoadKeys() (*KeySet, error) {
+	return p.keys, nil
+}
+
+func randomKey(t *testing.T, id string, status KeyStatus) Key {
+	t.Helper()
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		t.Fatal(err)
+	}
+	return Key{ID: id, Material: material, Status: status}
+}
+
+func randomKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+	keys := make([]Key, 0, len(ids))
+	for i, id := range ids {
+		status := KeyActive
+		if i == 0 {
+			status = KeyPrimary
+		}
+		keys = append(keys, randomKey(t, id, status))
+	}
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+// newTestMiddleware returns a GCM middleware with a random transport key
+// "transport-1"; fill sets the other keyrings.
+func newTestMiddleware(t *testing.T, fill func(*KeySet), opts ...Option) *CryptoMiddleware {
+	t.Helper()
+	keys := &KeySet{Keyring: randomKeyring(t, "transport-1"), IV: []byte("0123456789abcdef")}
+	if fill != nil {
+		fill(keys)
+	}
+	m, err := NewCryptoMiddleware(staticKeyProvider{keys}, ModeGCM, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// newTestRouter serves handler on every path behind the crypto middleware,
+// in the order main uses.
+func newTestRouter(m *CryptoMiddleware, handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(ErrorHandler(), m.VerifySignatureMiddleware(), m.DecryptRequestMiddleware(), m.EncryptResponseMiddleware())
+	r.Any("/*path", handler)
+	return r
+}
+
+// echoJSON responds with the request body as the data of a SuccessResponse.
+func echoJSON(c *gin.Context) {
+	var body interface{}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.Error(err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": body})
+}
+
+func serve(r http.Handler, method, target, contentType, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// mustSeal seals the JSON encoding of value as a v2 envelope, as a client does.
+func mustSeal(t *testing.T, key Key, value interface{}) string {
+	t.Helper()
+	plaintext, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := sealGCM(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return envelope
+}
+
+// mustOpen opens a v2 envelope and decodes the JSON value in it.
+func mustOpen(t *testing.T, keyring *Keyring, envelope interface{}) interface{} {
+	t.Helper()
+	s, ok := envelope.(string)
+	if !ok {
+		t.Fatalf("%v is not an envelope", envelope)
+	}
+	plaintext, err := openEnvelope(keyring, s)
+	if err != nil {
+		t.Fatalf("openEnvelope(%q): %v", s, err)
+	}
+	var value interface{}
+	if err := json.Unmarshal(plaintext, &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// responseData returns the "data" of a SuccessResponse body.
+func responseData(t *testing.T, w *httptest.ResponseRecorder) interface{} {
+	t.Helper()
+	var body struct {
+		Data interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response %s: %v", w.Body, err)
+	}
+	return body.Data
+}
@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) is a whole-body wire format for clients that must not
+// hold a key able to decrypt anyone else's traffic. The client encrypts the
+// request to a public key from HPKEPublicKeys, published at
+// /api/v1/crypto/keys, in base mode with
+//
+//	DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-256-GCM
+//
+// and info "encryption-test hpke v1". The request carries
+// SignatureTimestampHeader and SignatureNonceHeader as signed requests do,
+// and the plaintext is sealed with the associated data
+//
+//	METHOD \n request URI \n unix timestamp \n nonce
+//
+// so a body only opens for the request it was sealed for, within the
+// signature window, and only once: the nonce is remembered in the NonceStore.
+// That stands in for the request signature HPKE clients cannot make.
+//
+// The response is encrypted with AES-256-GCM under
+// Export("encryption-test hpke response v1", 32) of the request's context, a
+// key only that client can compute. Both bodies are sent as HPKEContentType:
+//
+//	request:  {"kid":"<key id>","enc":"<base64 encapsulated key>","ct":"<base64 ciphertext>"}
+//	response: {"ct":"<base64(nonce || ciphertext || tag)>"}
+//
+// The key pairs are derived with DeriveKeyPair from the keys in KeySet.HPKE,
+// so they rotate like any other keyring.
+const HPKEContentType = "application/vnd.hpke+json"
+
+// HPKE algorithm identifiers, RFC 9180 section 7.
+const (
+	HPKEKEMX25519SHA256 uint16 = 0x0020
+	HPKEKDFSHA256       uint16 = 0x0001
+	HPKEAEADAES256GCM   uint16 = 0x0002
+)
+
+const (
+	hpkeInfo            = "encryption-test hpke v1"
+	hpkeResponseContext = "encryption-test hpke response v1"
+)
+
+// hpkeContextKey records how to encrypt the response to an HPKE request.
+const hpkeContextKey = "cryptoHPKE"
+
+var (
+	ErrInvalidHPKE = errors.New("invalid HPKE body")
+	// ErrNoHPKEKeys is returned for HPKE requests without HPKE keys, see KeySet.HPKE.
+	ErrNoHPKEKeys = errors.New("no HPKE keys configured")
+)
+
+var (
+	hpkeKEMSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+	hpkeSuiteID    = []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x02}
+)
+
+// HPKEPublicKey is a server public key clients can encrypt requests to.
+type HPKEPublicKey struct {
+	Kid       string    `json:"kid"`
+	Status    KeyStatus `json:"status"`
+	KEM       uint16    `json:"kem_id"`
+	KDF       uint16    `json:"kdf_id"`
+	AEAD      uint16    `json:"aead_id"`
+	PublicKey string    `json:"public_key"` // base64 X25519 public key
+}
+
+type hpkeRequest struct {
+	Kid string `json:"kid"`
+	Enc string `json:"enc"`
+	Ct  string `json:"ct"`
+}
+
+type hpkeResponseBody struct {
+	Ct string `json:"ct"`
+}
+
+// hpkeResponse holds the key exported for the response to an HPKE request.
+type hpkeResponse struct {
+	key []byte
+}
+
+// isHPKEContentType reports whether value is HPKEContentType.
+func isHPKEContentType(value string) bool {
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+	return err == nil && mediaType == HPKEContentType
+}
+
+// HPKEPublicKeys returns the public keys of the primary and active HPKE
+// keys, primary first. Retiring keys still decrypt but are not published.
+func (m *CryptoMiddleware) HPKEPublicKeys() ([]HPKEPublicKey, error) {
+	if m.hpke == nil {
+		return nil, ErrNoHPKEKeys
+	}
+	primary := m.hpke.Primary()
+	keys := []Key{primary}
+	for _, key := range m.hpke.Keys() {
+		if key.Status == KeyActive {
+			keys = append(keys, key)
+		}
+	}
+
+	published := make([]HPKEPublicKey, 0, len(keys))
+	for _, key := range keys {
+		private, err := hpkeDeriveKeyPair(key.Material)
+		if err != nil {
+			return nil, err
+		}
+		published = append(published, HPKEPublicKey{
+			Kid:       key.ID,
+			Status:    key.Status,
+			KEM:       HPKEKEMX25519SHA256,
+			KDF:       HPKEKDFSHA256,
+			AEAD:      HPKEAEADAES256GCM,
+			PublicKey: base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+		})
+	}
+	return published, nil
+}
+
+// openHPKERequest opens the HPKE body of c, see HPKEContentType, and
+// remembers its nonce.
+func (m *CryptoMiddleware) openHPKERequest(c *gin.Context, body []byte) ([]byte, *hpkeResponse, error) {
+	timestamp, nonce, err := m.requestFreshness(c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidHPKE, err)
+	}
+	plaintext, response, err := m.openHPKE(body, hpkeAAD(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce))
+	if err != nil {
+		return nil, nil, err
+	}
+	// Only remember nonces of bodies that opened, so forged requests can't fill the store
+	if err := m.nonces.Remember("hpke:"+nonce, time.Unix(timestamp, 0).Add(m.signatureWindow)); err != nil {
+		return nil, nil, err
+	}
+	return plaintext, response, nil
+}
+
+// hpkeAAD is the associated data an HPKE request body is sealed with.
+func hpkeAAD(method, uri string, timestamp int64, nonce string) []byte {
+	return []byte(strings.Join([]string{method, uri, strconv.FormatInt(timestamp, 10), nonce}, "\n"))
+}
+
+// openHPKE decrypts an HPKE request body sealed with aad and returns the
+// plaintext and the key to encrypt the response with.
+func (m *CryptoMiddleware) openHPKE(body, aad []byte) ([]byte, *hpkeResponse, error) {
+	if m.hpke == nil {
+		return nil, nil, ErrNoHPKEKeys
+	}
+	var request hpkeRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidHPKE, err)
+	}
+	if request.Kid == "" || request.Enc == "" || request.Ct == "" {
+		return nil, nil, fmt.Errorf("%w: kid, enc and ct are required", ErrInvalidHPKE)
+	}
+	enc, err := base64.StdEncoding.DecodeString(request.Enc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: enc: %v", ErrInvalidHPKE, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(request.Ct)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: ct: %v", ErrInvalidHPKE, err)
+	}
+
+	key, err := m.hpke.Lookup(request.Kid)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := hpkeDeriveKeyPair(key.Material)
+	if err != nil {
+		return nil, nil, err
+	}
+	recipient, err := hpkeSetupBaseR(enc, private, []byte(hpkeInfo))
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := recipient.aead.Open(nil, recipient.baseNonce, ciphertext, aad)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: authentication failed", ErrInvalidHPKE)
+	}
+	return plaintext, &hpkeResponse{key: recipient.export([]byte(hpkeResponseContext), 32)}, nil
+}
+
+// sealHPKE encrypts the response to an HPKE request.
+func sealHPKE(response *hpkeResponse, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(response.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	return json.Marshal(hpkeResponseBody{Ct: base64.StdEncoding.EncodeToString(sealed)})
+}
+
+// hpkeContext is the receiver context of a single-shot base mode exchange.
+// Only the first message is opened, so the nonce is always the base nonce.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+}
+
+// export implements Context.Export, RFC 9180 section 5.3.
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(hpkeSuiteID, c.exporterSecret, "sec", exporterContext, length)
+}
+
+// hpkeDeriveKeyPair implements DeriveKeyPair for DHKEM(X25519, HKDF-SHA256),
+// RFC 9180 section 7.1.3.
+func hpkeDeriveKeyPair(ikm []byte) (*ecdh.PrivateKey, error) {
+	prk := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "dkp_prk", ikm)
+	return ecdh.X25519().NewPrivateKey(hpkeLabeledExpand(hpkeKEMSuiteID, prk, "sk", nil, 32))
+}
+
+// hpkeSetupBaseR implements SetupBaseR, RFC 9180 section 5.1.1: Decap
+// followed by the key schedule in mode_base.
+func hpkeSetupBaseR(enc []byte, private *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	sharedSecret, err := hpkeDecap(enc, private)
+	if err != nil {
+		return nil, err
+	}
+	key, baseNonce, exporterSecret := hpkeKeySchedule(hpkeSuiteID, sharedSecret, info, 32)
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{aead: aead, baseNonce: baseNonce, exporterSecret: exporterSecret}, nil
+}
+
+// hpkeDecap implements Decap for DHKEM(X25519, HKDF-SHA256), RFC 9180
+// section 4.1.
+func hpkeDecap(enc []byte, private *ecdh.PrivateKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: enc: %v", ErrInvalidHPKE, err)
+	}
+	dh, err := private.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidHPKE, err)
+	}
+	kemContext := append(append([]byte{}, enc...), private.PublicKey().Bytes()...)
+	eaePRK := hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(hpkeKEMSuiteID, eaePRK, "shared_secret", kemContext, 32), nil
+}
+
+// hpkeKeySchedule implements KeySchedule in mode_base with HKDF-SHA256 and a
+// GCM AEAD with keyLength byte keys, RFC 9180 section 5.1.
+func hpkeKeySchedule(suiteID, sharedSecret, info []byte, keyLength int) (key, baseNonce, exporterSecret []byte) {
+	keyScheduleContext := []byte{0x00} // mode_base
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	keyScheduleContext = append(keyScheduleContext, hpkeLabeledExtract(suiteID, nil, "info_hash", info)...)
+	secret := hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+
+	key = hpkeLabeledExpand(suiteID, secret, "key", keyScheduleContext, keyLength)
+	baseNonce = hpkeLabeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, 12)
+	exporterSecret = hpkeLabeledExpand(suiteID, secret, "exp", keyScheduleContext, sha256.Size)
+	return key, baseNonce, exporterSecret
+}
+
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := binary.BigEndian.AppendUint16(nil, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	// HKDF-SHA256 can expand to 8160 bytes, far more than any length used here
+	io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out)
+	return out
+}
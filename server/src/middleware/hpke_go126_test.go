@@ -0,0 +1,69 @@
+//go:build go1.26
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hpke"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestHPKEStandardLibrarySender checks a request sealed by crypto/hpke opens
+// and its response decrypts with the key crypto/hpke exports.
+func TestHPKEStandardLibrarySender(t *testing.T) {
+	r, m := newHPKETestRouter(t)
+	published, err := m.HPKEPublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(published[0].PublicKey)
+	public, err := hpke.DHKEM(ecdh.X25519()).NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, sender, err := hpke.NewSender(public, hpke.HKDFSHA256(), hpke.AES256GCM(), []byte(hpkeInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, nonce := time.Now().Unix(), "stdlib-nonce-0123456789"
+	ct, err := sender.Seal(hpkeAAD(http.MethodPost, "/api/v1/auth/login", timestamp, nonce), []byte(`{"ok":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(hpkeRequest{Kid: published[0].Kid, Enc: base64.StdEncoding.EncodeToString(enc), Ct: base64.StdEncoding.EncodeToString(ct)})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", HPKEContentType)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureNonceHeader, nonce)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+
+	responseKey, err := sender.Export(hpkeResponseContext, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed hpkeResponseBody
+	if err := json.Unmarshal(w.Body.Bytes(), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	sealedBytes, _ := base64.StdEncoding.DecodeString(sealed.Ct)
+	aead, err := newGCM(responseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := aead.Open(nil, sealedBytes[:aead.NonceSize()], sealedBytes[aead.NonceSize():], nil)
+	if err != nil || !bytes.Contains(plaintext, []byte(`"ok":true`)) {
+		t.Errorf("response = %s, %v", plaintext, err)
+	}
+}
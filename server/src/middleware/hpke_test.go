@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestHPKEKnownAnswer checks the KEM and key schedule against RFC 9180
+// A.1.1, DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM in base mode.
+// The suite differs from ours only in the AEAD, which the suite ID and key
+// length passed to hpkeKeySchedule account for.
+func TestHPKEKnownAnswer(t *testing.T) {
+	private, err := hpkeDeriveKeyPair(mustHex(t, "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := private.Bytes(), mustHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"); !bytes.Equal(got, want) {
+		t.Errorf("skRm = %x, want %x", got, want)
+	}
+	if got, want := private.PublicKey().Bytes(), mustHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d"); !bytes.Equal(got, want) {
+		t.Errorf("pkRm = %x, want %x", got, want)
+	}
+	ephemeral, err := hpkeDeriveKeyPair(mustHex(t, "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := mustHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	if got := ephemeral.PublicKey().Bytes(); !bytes.Equal(got, enc) {
+		t.Errorf("enc = %x, want %x", got, enc)
+	}
+
+	sharedSecret, err := hpkeDecap(enc, private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex(t, "fe0e18c9f024ce43799ae393c7e8fe8fce9d218875e8227b0187c04e7d2ea1fc"); !bytes.Equal(sharedSecret, want) {
+		t.Errorf("shared_secret = %x, want %x", sharedSecret, want)
+	}
+
+	aes128SuiteID := []byte{'H', 'P', 'K', 'E', 0x00, 0x20, 0x00, 0x01, 0x00, 0x01}
+	info := mustHex(t, "4f6465206f6e2061204772656369616e2055726e")
+	key, baseNonce, exporterSecret := hpkeKeySchedule(aes128SuiteID, sharedSecret, info, 16)
+	for _, check := range []struct {
+		name      string
+		got, want []byte
+	}{
+		{"key", key, mustHex(t, "4531685d41d65f03dc48f6b8302c05b0")},
+		{"base_nonce", baseNonce, mustHex(t, "56d890e5accaaf011cff4b7d")},
+		{"exporter_secret", exporterSecret, mustHex(t, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8")},
+	} {
+		if !bytes.Equal(check.got, check.want) {
+			t.Errorf("%s = %x, want %x", check.name, check.got, check.want)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext := mustHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	plaintext, err := aead.Open(nil, baseNonce, ciphertext, []byte("Count-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "Beauty is truth, truth beauty" {
+		t.Errorf("sequence 0 plaintext = %q", plaintext)
+	}
+}
+
+// hpkeSeal is the client side of HPKEContentType: SetupBaseS and a single
+// Seal, returning the request body and the key of the response.
+func hpkeSeal(t *testing.T, published HPKEPublicKey, aad, plaintext []byte) ([]byte, []byte) {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(published.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := ephemeral.PublicKey().Bytes()
+	kemContext := append(append([]byte{}, enc...), raw...)
+	sharedSecret := hpkeLabeledExpand(hpkeKEMSuiteID, hpkeLabeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh), "shared_secret", kemContext, 32)
+
+	key, baseNonce, exporterSecret := hpkeKeySchedule(hpkeSuiteID, sharedSecret, []byte(hpkeInfo), 32)
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(hpkeRequest{
+		Kid: published.Kid,
+		Enc: base64.StdEncoding.EncodeToString(enc),
+		Ct:  base64.StdEncoding.EncodeToString(aead.Seal(nil, baseNonce, plaintext, aad)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := hpkeContext{exporterSecret: exporterSecret}
+	return body, context.export([]byte(hpkeResponseContext), 32)
+}
+
+func newHPKETestRouter(t *testing.T) (*gin.Engine, *CryptoMiddleware) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/auth", Policy{Request: EncryptionRequired, Response: EncryptionRequired, Signed: true})
+	m := newTestMiddleware(t, func(keys *KeySet) {
+		keys.HPKE = randomKeyring(t, "hpke-1")
+	}, WithPolicies(policies))
+
+	r := gin.New()
+	r.Use(ErrorHandler(), m.VerifySignatureMiddleware(), m.DecryptRequestMiddleware(), m.EncryptResponseMiddleware())
+	r.POST("/api/v1/auth/login", func(c *gin.Context) {
+		var body map[string]interface{}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.Error(err)
+			return
+		}
+		c.JSON(http.StatusOK, body)
+	})
+	r.GET("/api/v1/auth/profile", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"name": "Jane"})
+	})
+	return r, m
+}
+
+// newHPKERequest seals plaintext for a POST to uri at timestamp and returns
+// a request to /api/v1/auth/login carrying it, with a copy of the body for
+// sending it again, and the response key.
+func newHPKERequest(t *testing.T, m *CryptoMiddleware, uri string, timestamp time.Time, nonce string, plaintext []byte) (*http.Request, []byte, []byte) {
+	t.Helper()
+	published, err := m.HPKEPublicKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, responseKey := hpkeSeal(t, published[0], hpkeAAD(http.MethodPost, uri, timestamp.Unix(), nonce), plaintext)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+	req.Header.Set("Content-Type", HPKEContentType)
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	req.Header.Set(SignatureNonceHeader, nonce)
+	return req, body, responseKey
+}
+
+func TestHPKERequestOnSignedRoute(t *testing.T) {
+	r, m := newHPKETestRouter(t)
+	req, body, responseKey := newHPKERequest(t, m, "/api/v1/auth/login", time.Now(), "nonce-0123456789ab", []byte(`{"email":"jane@example.com"}`))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); !isHPKEContentType(got) {
+		t.Errorf("response Content-Type = %q, want %s", got, HPKEContentType)
+	}
+	var sealed hpkeResponseBody
+	if err := json.Unmarshal(w.Body.Bytes(), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(sealed.Ct)
+	aead, err := newGCM(responseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		t.Fatalf("response does not open with the exported key: %v", err)
+	}
+	if !bytes.Contains(plaintext, []byte("jane@example.com")) {
+		t.Errorf("response = %s", plaintext)
+	}
+
+	// The same body again is a replay
+	replay := httptest.NewRequest(http.MethodPost, "/api/v1/auth/login", bytes.NewReader(body))
+	replay.Header = req.Header.Clone()
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, replay)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("replay status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestHPKERequestRejected(t *testing.T) {
+	r, m := newHPKETestRouter(t)
+	for _, tc := range []struct {
+		name   string
+		mutate func(*http.Request)
+		uri    string
+		at     time.Time
+	}{
+		{name: "sealed for another URI", uri: "/api/v1/auth/register", at: time.Now()},
+		{name: "stale timestamp", uri: "/api/v1/auth/login", at: time.Now().Add(-time.Hour)},
+		{name: "timestamp changed", uri: "/api/v1/auth/login", at: time.Now(), mutate: func(req *http.Request) {
+			req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(time.Now().Unix()+1, 10))
+		}},
+		{name: "nonce changed", uri: "/api/v1/auth/login", at: time.Now(), mutate: func(req *http.Request) {
+			req.Header.Set(SignatureNonceHeader, "another-nonce-0123")
+		}},
+		{name: "no nonce", uri: "/api/v1/auth/login", at: time.Now(), mutate: func(req *http.Request) {
+			req.Header.Del(SignatureNonceHeader)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _, _ := newHPKERequest(t, m, tc.uri, tc.at, "nonce-"+tc.name+"-0123456789", []byte(`{"a":1}`))
+			if tc.mutate != nil {
+				tc.mutate(req)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+}
+
+// TestHPKERequestWithoutBody checks the HPKE content type does not stand in
+// for a signature when there is no body whose AAD binds the nonce.
+func TestHPKERequestWithoutBody(t *testing.T) {
+	r, _ := newHPKETestRouter(t)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		target := "/api/v1/auth/profile"
+		if method == http.MethodPost {
+			target = "/api/v1/auth/login"
+		}
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Content-Type", HPKEContentType)
+		req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		req.Header.Set(SignatureNonceHeader, "nonce-0123456789ab")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: status = %d, want %d: %s", method, target, w.Code, http.StatusUnauthorized, w.Body)
+		}
+	}
+}
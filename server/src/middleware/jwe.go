@@ -0,0 +1,512 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// JWE (RFC 7516) is an alternative wire format for whole bodies, negotiated
+// with Content-Type and Accept:
+//
+//	application/jose       compact serialization
+//	application/jose+json  JSON serialization (flattened or general)
+//
+// Supported algorithms are "dir", "ECDH-ES" and "ECDH-ES+A256KW", with
+// "A256GCM" content encryption. "dir" uses the keyring keys directly. The
+// ECDH-ES variants use X25519 and P-256 keys derived from the server-only
+// keys in KeySet.JWE, published by JWKS under the same key IDs, so a client
+// holding the transport keys still cannot read another client's JWEs.
+const (
+	JOSEContentType     = "application/jose"
+	JOSEJSONContentType = "application/jose+json"
+)
+
+const (
+	jweAlgDir          = "dir"
+	jweAlgECDHES       = "ECDH-ES"
+	jweAlgECDHESA256KW = "ECDH-ES+A256KW"
+	jweEncA256GCM      = "A256GCM"
+)
+
+// jweContextKey records how to encrypt the response to a JWE request.
+const jweContextKey = "cryptoJWE"
+
+var (
+	ErrInvalidJWE = errors.New("invalid JWE")
+	// ErrNoJWEKeys is returned for ECDH-ES without JWE keys, see KeySet.JWE.
+	ErrNoJWEKeys = errors.New("no JWE keys configured")
+)
+
+var b64url = base64.RawURLEncoding
+
+// JWK is a public JSON Web Key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+type jweHeader struct {
+	Alg  string   `json:"alg"`
+	Enc  string   `json:"enc"`
+	Kid  string   `json:"kid,omitempty"`
+	Epk  *JWK     `json:"epk,omitempty"`
+	Apu  string   `json:"apu,omitempty"`
+	Apv  string   `json:"apv,omitempty"`
+	Zip  string   `json:"zip,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+// jweJSON covers both the flattened and the general JSON serialization.
+type jweJSON struct {
+	Protected    string          `json:"protected,omitempty"`
+	Unprotected  json.RawMessage `json:"unprotected,omitempty"`
+	Header       json.RawMessage `json:"header,omitempty"`
+	EncryptedKey string          `json:"encrypted_key,omitempty"`
+	Recipients   []struct {
+		Header       json.RawMessage `json:"header,omitempty"`
+		EncryptedKey string          `json:"encrypted_key,omitempty"`
+	} `json:"recipients,omitempty"`
+	AAD        string `json:"aad,omitempty"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	Tag        string `json:"tag"`
+}
+
+// jweResponse says how to encrypt the response: always "dir" with key, in
+// the serialization the client used.
+type jweResponse struct {
+	json bool
+	kid  string
+	key  []byte
+}
+
+func (r *jweResponse) contentType() string {
+	if r.json {
+		return JOSEJSONContentType
+	}
+	return JOSEContentType
+}
+
+// joseContentType reports whether value is a JOSE media type and whether it
+// is the JSON serialization.
+func joseContentType(value string) (ok bool, jsonSerialization bool) {
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(value))
+	if err != nil {
+		return false, false
+	}
+	switch mediaType {
+	case JOSEContentType:
+		return true, false
+	case JOSEJSONContentType:
+		return true, true
+	}
+	return false, false
+}
+
+// openJWE decrypts a JWE body and returns the plaintext and how to encrypt the response.
+func (m *CryptoMiddleware) openJWE(body []byte, jsonSerialization bool) ([]byte, *jweResponse, error) {
+	if !jsonSerialization {
+		parts := strings.Split(strings.TrimSpace(string(body)), ".")
+		if len(parts) != 5 {
+			return nil, nil, fmt.Errorf("%w: compact serialization must have 5 parts", ErrInvalidJWE)
+		}
+		header, err := mergeJWEHeaders(parts[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return m.openJWERecipient(header, parts[1], parts[2], parts[3], parts[4], []byte(parts[0]), false)
+	}
+
+	var jwe jweJSON
+	if err := json.Unmarshal(body, &jwe); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidJWE, err)
+	}
+	aad := []byte(jwe.Protected)
+	if jwe.AAD != "" {
+		aad = append(aad, '.')
+		aad = append(aad, jwe.AAD...)
+	}
+
+	if len(jwe.Recipients) == 0 {
+		header, err := mergeJWEHeaders(jwe.Protected, jwe.Unprotected, jwe.Header)
+		if err != nil {
+			return nil, nil, err
+		}
+		return m.openJWERecipient(header, jwe.EncryptedKey, jwe.IV, jwe.Ciphertext, jwe.Tag, aad, true)
+	}
+
+	// General serialization: use the first recipient we hold a key for
+	err := fmt.Errorf("%w: no recipient could be decrypted", ErrInvalidJWE)
+	for _, recipient := range jwe.Recipients {
+		header, headerErr := mergeJWEHeaders(jwe.Protected, jwe.Unprotected, recipient.Header)
+		if headerErr != nil {
+			return nil, nil, headerErr
+		}
+		plaintext, response, openErr := m.openJWERecipient(header, recipient.EncryptedKey, jwe.IV, jwe.Ciphertext, jwe.Tag, aad, true)
+		if openErr == nil {
+			return plaintext, response, nil
+		}
+		err = openErr
+	}
+	return nil, nil, err
+}
+
+func (m *CryptoMiddleware) openJWERecipient(header *jweHeader, encryptedKey, iv, ciphertext, tag string, aad []byte, jsonSerialization bool) ([]byte, *jweResponse, error) {
+	if header.Enc != jweEncA256GCM {
+		return nil, nil, fmt.Errorf("%w: unsupported enc %q", ErrInvalidJWE, header.Enc)
+	}
+	if header.Zip != "" || len(header.Crit) > 0 {
+		return nil, nil, fmt.Errorf("%w: zip and crit are not supported", ErrInvalidJWE)
+	}
+	wrappedKey, err := b64url.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: encrypted_key: %v", ErrInvalidJWE, err)
+	}
+
+	var cek []byte
+	response := &jweResponse{json: jsonSerialization}
+	switch header.Alg {
+	case jweAlgDir:
+		if len(wrappedKey) != 0 {
+			return nil, nil, fmt.Errorf("%w: dir must not have an encrypted key", ErrInvalidJWE)
+		}
+		key, err := m.jweKey(m.keyring, header.Kid)
+		if err != nil {
+			return nil, nil, err
+		}
+		cek = key.Material
+		primary := m.keyring.Primary()
+		response.kid, response.key = primary.ID, primary.Material
+	case jweAlgECDHES, jweAlgECDHESA256KW:
+		if m.jwe == nil {
+			return nil, nil, ErrNoJWEKeys
+		}
+		key, err := m.jweKey(m.jwe, header.Kid)
+		if err != nil {
+			return nil, nil, err
+		}
+		secret, err := jweAgree(key, header.Epk)
+		if err != nil {
+			return nil, nil, err
+		}
+		if header.Alg == jweAlgECDHES {
+			if len(wrappedKey) != 0 {
+				return nil, nil, fmt.Errorf("%w: ECDH-ES must not have an encrypted key", ErrInvalidJWE)
+			}
+			cek, err = concatKDF(secret, header.Enc, header.Apu, header.Apv, 32)
+			if err != nil {
+				return nil, nil, err
+			}
+		} else {
+			kek, err := concatKDF(secret, header.Alg, header.Apu, header.Apv, 32)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cek, err = aesKeyUnwrap(kek, wrappedKey); err != nil {
+				return nil, nil, err
+			}
+		}
+		// Only this client knows the CEK, so answer under it rather than a shared key
+		response.key = cek
+	default:
+		return nil, nil, fmt.Errorf("%w: unsupported alg %q", ErrInvalidJWE, header.Alg)
+	}
+
+	if len(cek) != 32 {
+		return nil, nil, fmt.Errorf("%w: A256GCM needs a 32 byte CEK (got %d bytes)", ErrInvalidJWE, len(cek))
+	}
+
+	nonce, err := b64url.DecodeString(iv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: iv: %v", ErrInvalidJWE, err)
+	}
+	sealed, err := b64url.DecodeString(ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: ciphertext: %v", ErrInvalidJWE, err)
+	}
+	authTag, err := b64url.DecodeString(tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: tag: %v", ErrInvalidJWE, err)
+	}
+
+	aead, err := newGCM(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(nonce) != aead.NonceSize() || len(authTag) != aead.Overhead() {
+		return nil, nil, fmt.Errorf("%w: bad iv or tag length", ErrInvalidJWE)
+	}
+	plaintext, err := aead.Open(nil, nonce, append(sealed, authTag...), aad)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: authentication failed", ErrInvalidJWE)
+	}
+	return plaintext, response, nil
+}
+
+// sealJWE encrypts plaintext as a "dir"/"A256GCM" JWE.
+func sealJWE(response *jweResponse, plaintext []byte) ([]byte, error) {
+	protectedJSON, err := json.Marshal(jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM, Kid: response.kid})
+	if err != nil {
+		return nil, err
+	}
+	protected := b64url.EncodeToString(protectedJSON)
+
+	aead, err := newGCM(response.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	if response.json {
+		return json.Marshal(jweJSON{
+			Protected:  protected,
+			IV:         b64url.EncodeToString(nonce),
+			Ciphertext: b64url.EncodeToString(ciphertext),
+			Tag:        b64url.EncodeToString(tag),
+		})
+	}
+	return []byte(strings.Join([]string{
+		protected,
+		"",
+		b64url.EncodeToString(nonce),
+		b64url.EncodeToString(ciphertext),
+		b64url.EncodeToString(tag),
+	}, ".")), nil
+}
+
+// jweResponseFor returns how to encrypt the response as JWE, if at all: as
+// agreed by a JWE request, or with the primary key when the client only
+// asked for JOSE in Accept.
+func (m *CryptoMiddleware) jweResponseFor(c *gin.Context) (*jweResponse, bool) {
+	if response, ok := c.Get(jweContextKey); ok {
+		return response.(*jweResponse), true
+	}
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		if ok, jsonSerialization := joseContentType(accepted); ok {
+			primary := m.keyring.Primary()
+			return &jweResponse{json: jsonSerialization, kid: primary.ID, key: primary.Material}, true
+		}
+	}
+	return nil, false
+}
+
+// mergeJWEHeaders joins the protected header with the unprotected ones.
+// RFC 7516 requires their parameter names to be disjoint.
+func mergeJWEHeaders(protected string, unprotected ...json.RawMessage) (*jweHeader, error) {
+	params := map[string]json.RawMessage{}
+	if protected != "" {
+		decoded, err := b64url.DecodeString(protected)
+		if err != nil {
+			return nil, fmt.Errorf("%w: protected header: %v", ErrInvalidJWE, err)
+		}
+		if err := json.Unmarshal(decoded, &params); err != nil {
+			return nil, fmt.Errorf("%w: protected header: %v", ErrInvalidJWE, err)
+		}
+	}
+	for _, raw := range unprotected {
+		if len(raw) == 0 {
+			continue
+		}
+		var extra map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &extra); err != nil {
+			return nil, fmt.Errorf("%w: header: %v", ErrInvalidJWE, err)
+		}
+		for name, value := range extra {
+			if _, ok := params[name]; ok {
+				return nil, fmt.Errorf("%w: duplicate header parameter %q", ErrInvalidJWE, name)
+			}
+			params[name] = value
+		}
+	}
+
+	merged, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var header jweHeader
+	if err := json.Unmarshal(merged, &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidJWE, err)
+	}
+	return &header, nil
+}
+
+// jweKey returns the key in keyring named by kid, or the primary key when the
+// JWE has no kid.
+func (m *CryptoMiddleware) jweKey(keyring *Keyring, kid string) (Key, error) {
+	if kid == "" {
+		return keyring.Primary(), nil
+	}
+	return keyring.Lookup(kid)
+}
+
+// jweStaticKey derives the ECDH key published for a JWE key.
+func jweStaticKey(curve ecdh.Curve, crv string, key Key) (*ecdh.PrivateKey, error) {
+	reader := hkdf.New(sha256.New, key.Material, nil, []byte("encryption-test jwe "+crv))
+	scalar := make([]byte, 32)
+	// A P-256 scalar must be below the group order, so retry with fresh HKDF output on the rare miss
+	for i := 0; i < 8; i++ {
+		if _, err := io.ReadFull(reader, scalar); err != nil {
+			return nil, err
+		}
+		if private, err := curve.NewPrivateKey(scalar); err == nil {
+			return private, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to derive %s key for %q", crv, key.ID)
+}
+
+// jweAgree runs ECDH between the static key derived from key and the sender's ephemeral key.
+func jweAgree(key Key, epk *JWK) ([]byte, error) {
+	if epk == nil {
+		return nil, fmt.Errorf("%w: missing epk", ErrInvalidJWE)
+	}
+	x, err := b64url.DecodeString(epk.X)
+	if err != nil {
+		return nil, fmt.Errorf("%w: epk: %v", ErrInvalidJWE, err)
+	}
+
+	var curve ecdh.Curve
+	var raw []byte
+	switch {
+	case epk.Kty == "OKP" && epk.Crv == "X25519":
+		curve, raw = ecdh.X25519(), x
+	case epk.Kty == "EC" && epk.Crv == "P-256":
+		y, err := b64url.DecodeString(epk.Y)
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("%w: invalid P-256 epk", ErrInvalidJWE)
+		}
+		curve, raw = ecdh.P256(), append(append([]byte{4}, x...), y...)
+	default:
+		return nil, fmt.Errorf("%w: unsupported epk %s/%s", ErrInvalidJWE, epk.Kty, epk.Crv)
+	}
+
+	peer, err := curve.NewPublicKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: epk: %v", ErrInvalidJWE, err)
+	}
+	private, err := jweStaticKey(curve, epk.Crv, key)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidJWE, err)
+	}
+	return secret, nil
+}
+
+// JWKS returns the public ECDH-ES keys for every JWE key, one X25519 and one
+// P-256 key per key ID.
+func (m *CryptoMiddleware) JWKS() ([]JWK, error) {
+	if m.jwe == nil {
+		return nil, ErrNoJWEKeys
+	}
+	var keys []JWK
+	for _, key := range m.jwe.Keys() {
+		x25519, err := jweStaticKey(ecdh.X25519(), "X25519", key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, JWK{
+			Kty: "OKP", Crv: "X25519", Kid: key.ID, Use: "enc", Alg: jweAlgECDHESA256KW,
+			X: b64url.EncodeToString(x25519.PublicKey().Bytes()),
+		})
+
+		p256, err := jweStaticKey(ecdh.P256(), "P-256", key)
+		if err != nil {
+			return nil, err
+		}
+		point := p256.PublicKey().Bytes() // 0x04 || X || Y
+		keys = append(keys, JWK{
+			Kty: "EC", Crv: "P-256", Kid: key.ID, Use: "enc", Alg: jweAlgECDHESA256KW,
+			X: b64url.EncodeToString(point[1:33]),
+			Y: b64url.EncodeToString(point[33:]),
+		})
+	}
+	return keys, nil
+}
+
+// concatKDF is the single-step KDF of NIST SP 800-56A as profiled by
+// RFC 7518 section 4.6.2, for output of up to 256 bits.
+func concatKDF(secret []byte, algorithm, apu, apv string, keyLength int) ([]byte, error) {
+	partyU, err := b64url.DecodeString(apu)
+	if err != nil {
+		return nil, fmt.Errorf("%w: apu: %v", ErrInvalidJWE, err)
+	}
+	partyV, err := b64url.DecodeString(apv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: apv: %v", ErrInvalidJWE, err)
+	}
+
+	var otherInfo bytes.Buffer
+	for _, field := range [][]byte{[]byte(algorithm), partyU, partyV} {
+		binary.Write(&otherInfo, binary.BigEndian, uint32(len(field)))
+		otherInfo.Write(field)
+	}
+	binary.Write(&otherInfo, binary.BigEndian, uint32(keyLength*8)) // keydatalen in bits
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, uint32(1)) // round counter
+	h.Write(secret)
+	h.Write(otherInfo.Bytes())
+	return h.Sum(nil)[:keyLength], nil
+}
+
+var aesKeyWrapIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// aesKeyUnwrap implements RFC 3394 AES key unwrap.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, fmt.Errorf("%w: wrapped key has an invalid length", ErrInvalidJWE)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	r := make([]byte, len(wrapped)-8)
+	copy(r, wrapped[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[(i-1)*8:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(a, aesKeyWrapIV) != 1 {
+		return nil, fmt.Errorf("%w: key unwrap failed", ErrInvalidJWE)
+	}
+	return r, nil
+}
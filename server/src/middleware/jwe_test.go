@@ -0,0 +1,295 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestConcatKDFKnownAnswer is the ECDH-ES example of RFC 7518 Appendix C.
+func TestConcatKDFKnownAnswer(t *testing.T) {
+	z := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156,
+		251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	key, err := concatKDF(z, "A128GCM", "QWxpY2U", "Qm9i", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b64url.EncodeToString(key); got != "VqqN6vgjbSBcIijNcacQGg" {
+		t.Errorf("derived key = %s, want VqqN6vgjbSBcIijNcacQGg", got)
+	}
+
+	if _, err := concatKDF(z, "A256GCM", "not base64!", "", 32); !errors.Is(err, ErrInvalidJWE) {
+		t.Errorf("concatKDF with a bad apu = %v, want ErrInvalidJWE", err)
+	}
+}
+
+// TestAESKeyUnwrapKnownAnswer is RFC 3394 section 4.6, 256 bits of key data
+// with a 256-bit KEK.
+func TestAESKeyUnwrapKnownAnswer(t *testing.T) {
+	kek := mustHex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	keyData := mustHex(t, "00112233445566778899aabbccddeeff000102030405060708090a0b0c0d0e0f")
+	wrapped := mustHex(t, "28c9f404c4b810f4cbccb35cfb87f8263f5786e2d80ed326cbc7f0e71a99f43bfb988b9b7a02dd21")
+
+	if got := aesKeyWrap(t, kek, keyData); !bytes.Equal(got, wrapped) {
+		t.Errorf("test wrap = %x, want %x", got, wrapped)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, keyData) {
+		t.Errorf("aesKeyUnwrap = %x, want %x", unwrapped, keyData)
+	}
+
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := aesKeyUnwrap(kek, tampered); !errors.Is(err, ErrInvalidJWE) {
+		t.Errorf("aesKeyUnwrap of a tampered key = %v, want ErrInvalidJWE", err)
+	}
+	if _, err := aesKeyUnwrap(kek, wrapped[:20]); !errors.Is(err, ErrInvalidJWE) {
+		t.Errorf("aesKeyUnwrap of a short key = %v, want ErrInvalidJWE", err)
+	}
+}
+
+// aesKeyWrap is the sender side of RFC 3394, which the server never needs.
+func aesKeyWrap(t *testing.T, kek, keyData []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(keyData) / 8
+	a := append([]byte{}, aesKeyWrapIV...)
+	r := append([]byte{}, keyData...)
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, a)
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Encrypt(buf, buf)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^uint64(n*j+i))
+			copy(r[(i-1)*8:], buf[8:])
+		}
+	}
+	return append(a, r...)
+}
+
+// jweSeal builds a compact JWE of plaintext under cek with the given header.
+func jweSeal(t *testing.T, header jweHeader, encryptedKey, cek, plaintext []byte) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protected := b64url.EncodeToString(headerJSON)
+	aead, err := newGCM(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, nonce, plaintext, []byte(protected))
+	overhead := len(sealed) - aead.Overhead()
+	return strings.Join([]string{
+		protected,
+		b64url.EncodeToString(encryptedKey),
+		b64url.EncodeToString(nonce),
+		b64url.EncodeToString(sealed[:overhead]),
+		b64url.EncodeToString(sealed[overhead:]),
+	}, ".")
+}
+
+// jweOpen opens a "dir" JWE response in either serialization.
+func jweOpen(t *testing.T, body []byte, cek []byte) []byte {
+	t.Helper()
+	var jwe jweJSON
+	if err := json.Unmarshal(body, &jwe); err != nil {
+		parts := strings.Split(string(body), ".")
+		if len(parts) != 5 {
+			t.Fatalf("response %s is not a JWE", body)
+		}
+		jwe = jweJSON{Protected: parts[0], IV: parts[2], Ciphertext: parts[3], Tag: parts[4]}
+	}
+	header, err := mergeJWEHeaders(jwe.Protected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Alg != jweAlgDir || header.Enc != jweEncA256GCM {
+		t.Errorf("response header = %+v, want dir/A256GCM", header)
+	}
+	nonce, _ := b64url.DecodeString(jwe.IV)
+	ciphertext, _ := b64url.DecodeString(jwe.Ciphertext)
+	tag, _ := b64url.DecodeString(jwe.Tag)
+	aead, err := newGCM(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := aead.Open(nil, nonce, append(ciphertext, tag...), []byte(jwe.Protected))
+	if err != nil {
+		t.Fatalf("response does not open: %v", err)
+	}
+	return plaintext
+}
+
+// ecdhESSender runs the sender side of ECDH-ES against the published jwk and
+// returns the epk header and the key derived for algorithm.
+func ecdhESSender(t *testing.T, jwk JWK, algorithm string) (*JWK, []byte) {
+	t.Helper()
+	x, _ := b64url.DecodeString(jwk.X)
+	curve, raw := ecdh.Curve(ecdh.X25519()), x
+	if jwk.Crv == "P-256" {
+		y, _ := b64url.DecodeString(jwk.Y)
+		curve, raw = ecdh.P256(), append(append([]byte{4}, x...), y...)
+	}
+	recipient, err := curve.NewPublicKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := concatKDF(secret, algorithm, "", "", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epk := &JWK{Kty: jwk.Kty, Crv: jwk.Crv}
+	point := ephemeral.PublicKey().Bytes()
+	if jwk.Crv == "P-256" {
+		epk.X, epk.Y = b64url.EncodeToString(point[1:33]), b64url.EncodeToString(point[33:])
+	} else {
+		epk.X = b64url.EncodeToString(point)
+	}
+	return epk, key
+}
+
+func newJWETestMiddleware(t *testing.T) *CryptoMiddleware {
+	t.Helper()
+	return newTestMiddleware(t, func(keys *KeySet) {
+		keys.JWE = randomKeyring(t, "jwe-1")
+	})
+}
+
+func TestJWERoundTrip(t *testing.T) {
+	m := newJWETestMiddleware(t)
+	r := newTestRouter(m, echoJSON)
+	jwks, err := m.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks) != 2 {
+		t.Fatalf("JWKS has %d keys, want an X25519 and a P-256 key", len(jwks))
+	}
+	transport := m.keyring.Primary()
+	plaintext := []byte(`{"email":"jane@example.com"}`)
+
+	type request struct {
+		name string
+		body string
+		cek  []byte // key of the response
+	}
+	var requests []request
+	requests = append(requests, request{
+		name: "dir",
+		body: jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM, Kid: transport.ID}, nil, transport.Material, plaintext),
+		cek:  transport.Material,
+	})
+	for _, jwk := range jwks {
+		epk, cek := ecdhESSender(t, jwk, jweEncA256GCM)
+		requests = append(requests, request{
+			name: jweAlgECDHES + " " + jwk.Crv,
+			body: jweSeal(t, jweHeader{Alg: jweAlgECDHES, Enc: jweEncA256GCM, Kid: jwk.Kid, Epk: epk}, nil, cek, plaintext),
+			cek:  cek,
+		})
+
+		epk, kek := ecdhESSender(t, jwk, jweAlgECDHESA256KW)
+		cek = randomKey(t, "cek", KeyPrimary).Material
+		requests = append(requests, request{
+			name: jweAlgECDHESA256KW + " " + jwk.Crv,
+			body: jweSeal(t, jweHeader{Alg: jweAlgECDHESA256KW, Enc: jweEncA256GCM, Kid: jwk.Kid, Epk: epk}, aesKeyWrap(t, kek, cek), cek, plaintext),
+			cek:  cek,
+		})
+	}
+
+	for _, tc := range requests {
+		for _, contentType := range []string{JOSEContentType, JOSEJSONContentType} {
+			t.Run(tc.name+" "+contentType, func(t *testing.T) {
+				body := tc.body
+				if contentType == JOSEJSONContentType {
+					parts := strings.Split(body, ".")
+					flattened, _ := json.Marshal(jweJSON{Protected: parts[0], EncryptedKey: parts[1], IV: parts[2], Ciphertext: parts[3], Tag: parts[4]})
+					body = string(flattened)
+				}
+				w := serve(r, http.MethodPost, "/api/v1/users", contentType, body, nil)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+				if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, contentType) {
+					t.Errorf("response Content-Type = %q, want %s", got, contentType)
+				}
+				if response := jweOpen(t, w.Body.Bytes(), tc.cek); !bytes.Contains(response, []byte("jane@example.com")) {
+					t.Errorf("response = %s", response)
+				}
+			})
+		}
+	}
+}
+
+func TestJWERejected(t *testing.T) {
+	m := newJWETestMiddleware(t)
+	r := newTestRouter(m, echoJSON)
+	jwks, err := m.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := m.keyring.Primary()
+	plaintext := []byte(`{"a":1}`)
+	epk, kek := ecdhESSender(t, jwks[0], jweAlgECDHESA256KW)
+	shortCEK := transport.Material[:16]
+
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{"unsupported enc", jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: "A128GCM"}, nil, transport.Material, plaintext)},
+		{"unsupported alg", jweSeal(t, jweHeader{Alg: "RSA-OAEP", Enc: jweEncA256GCM}, nil, transport.Material, plaintext)},
+		{"dir with an encrypted key", jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM}, []byte("key"), transport.Material, plaintext)},
+		{"zip", jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM, Zip: "DEF"}, nil, transport.Material, plaintext)},
+		{"unknown kid", jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM, Kid: "nope"}, nil, transport.Material, plaintext)},
+		{"wrong key", jweSeal(t, jweHeader{Alg: jweAlgDir, Enc: jweEncA256GCM}, nil, randomKey(t, "x", KeyPrimary).Material, plaintext)},
+		{"128-bit CEK", jweSeal(t, jweHeader{Alg: jweAlgECDHESA256KW, Enc: jweEncA256GCM, Kid: jwks[0].Kid, Epk: epk}, aesKeyWrap(t, kek, shortCEK), transport.Material, plaintext)},
+		{"four parts", "a.b.c.d"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, "/api/v1/users", JOSEContentType, tc.body, nil)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+		})
+	}
+}
+
+func TestJWEWithoutJWEKeys(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	if _, err := m.JWKS(); !errors.Is(err, ErrNoJWEKeys) {
+		t.Errorf("JWKS without JWE keys = %v, want ErrNoJWEKeys", err)
+	}
+	_, _, err := m.openJWE([]byte(jweSeal(t, jweHeader{Alg: jweAlgECDHES, Enc: jweEncA256GCM}, nil, randomKey(t, "x", KeyPrimary).Material, nil)), false)
+	if !errors.Is(err, ErrNoJWEKeys) {
+		t.Errorf("ECDH-ES without JWE keys = %v, want ErrNoJWEKeys", err)
+	}
+}
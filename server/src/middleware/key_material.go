@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ParseKeyMaterial decodes a key written as "base64:<standard or URL-safe
+// base64>" or "hex:<hex>". Anything else is taken as raw text whose bytes are
+// the key, as AES_SECRET_KEY always was; such keys are limited to printable
+// characters and are only accepted for existing deployments.
+func ParseKeyMaterial(s string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(s, "base64:"):
+		encoded := strings.TrimRight(strings.TrimPrefix(s, "base64:"), "=")
+		if strings.ContainsAny(encoded, "-_") {
+			return base64.RawURLEncoding.DecodeString(encoded)
+		}
+		return base64.RawStdEncoding.DecodeString(encoded)
+	case strings.HasPrefix(s, "hex:"):
+		return hex.DecodeString(strings.TrimPrefix(s, "hex:"))
+	default:
+		return []byte(s), nil
+	}
+}
+
+// KDF algorithms for deriving a key from a passphrase.
+const (
+	// KDFArgon2id stretches human-chosen passphrases, making each guess cost
+	// the configured memory and time.
+	KDFArgon2id = "argon2id"
+	// KDFHKDF only extracts and expands, so it is for passphrases that are
+	// already random secrets and fails the entropy check otherwise.
+	KDFHKDF = "hkdf-sha256"
+)
+
+const (
+	// kdfInfo is the HKDF info for passphrase-derived keys.
+	kdfInfo = "encryption-test passphrase key v1"
+
+	minKDFSaltBytes     = 16
+	minArgon2Memory     = 19 * 1024 // KiB, the OWASP minimum for Argon2id
+	minArgon2Time       = 2
+	minPassphraseLength = 12
+)
+
+// KDFParams says how a key is derived from a passphrase. The parameters are
+// not secret and are stored alongside the deployment's configuration, in a
+// PHC-style string:
+//
+//	$argon2id$v=19$m=65536,t=3,p=4$<base64 salt>
+//	$hkdf-sha256$<base64 salt>
+//
+// The salt must stay the same for as long as the key is in use: a new salt
+// derives a different key.
+type KDFParams struct {
+	Algorithm string
+	Salt      []byte
+	Memory    uint32 // Argon2id memory in KiB
+	Time      uint32 // Argon2id passes
+	Threads   uint8  // Argon2id lanes
+}
+
+// NewKDFParams returns Argon2id parameters with a fresh random salt.
+func NewKDFParams() (KDFParams, error) {
+	salt := make([]byte, minKDFSaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return KDFParams{}, err
+	}
+	return KDFParams{Algorithm: KDFArgon2id, Salt: salt, Memory: 64 * 1024, Time: 3, Threads: 4}, nil
+}
+
+// ParseKDFParams parses the string form of KDFParams.
+func ParseKDFParams(s string) (KDFParams, error) {
+	fields := strings.Split(strings.TrimPrefix(s, "$"), "$")
+	var params KDFParams
+	var salt string
+	switch {
+	case len(fields) == 4 && fields[0] == KDFArgon2id:
+		if fields[1] != "v="+strconv.Itoa(argon2.Version) {
+			return KDFParams{}, fmt.Errorf("unsupported argon2id version %q", fields[1])
+		}
+		var threads uint32
+		if _, err := fmt.Sscanf(fields[2], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &threads); err != nil {
+			return KDFParams{}, fmt.Errorf("invalid argon2id parameters %q", fields[2])
+		}
+		if threads == 0 || threads > math.MaxUint8 {
+			return KDFParams{}, fmt.Errorf("argon2id threads must be between 1 and %d", math.MaxUint8)
+		}
+		params.Algorithm, params.Threads, salt = KDFArgon2id, uint8(threads), fields[3]
+	case len(fields) == 2 && fields[0] == KDFHKDF:
+		params.Algorithm, salt = KDFHKDF, fields[1]
+	default:
+		return KDFParams{}, fmt.Errorf("unknown key derivation %q, expected $%s$... or $%s$...", s, KDFArgon2id, KDFHKDF)
+	}
+
+	var err error
+	if params.Salt, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(salt, "=")); err != nil {
+		return KDFParams{}, fmt.Errorf("invalid key derivation salt: %w", err)
+	}
+	return params, params.validate()
+}
+
+func (p KDFParams) validate() error {
+	if len(p.Salt) < minKDFSaltBytes {
+		return fmt.Errorf("key derivation salt must be at least %d bytes (got %d bytes)", minKDFSaltBytes, len(p.Salt))
+	}
+	if p.Algorithm == KDFArgon2id && (p.Memory < minArgon2Memory || p.Time < minArgon2Time) {
+		return fmt.Errorf("argon2id needs at least m=%d and t=%d", minArgon2Memory, minArgon2Time)
+	}
+	return nil
+}
+
+func (p KDFParams) String() string {
+	salt := base64.RawStdEncoding.EncodeToString(p.Salt)
+	if p.Algorithm == KDFHKDF {
+		return "$" + KDFHKDF + "$" + salt
+	}
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s", KDFArgon2id, argon2.Version, p.Memory, p.Time, p.Threads, salt)
+}
+
+// DeriveKey derives a 32-byte key from passphrase.
+func (p KDFParams) DeriveKey(passphrase []byte) ([]byte, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	switch p.Algorithm {
+	case KDFArgon2id:
+		if len(passphrase) < minPassphraseLength {
+			return nil, fmt.Errorf("passphrase must be at least %d characters", minPassphraseLength)
+		}
+		return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, 32), nil
+	case KDFHKDF:
+		if err := checkEntropy(passphrase); err != nil {
+			return nil, fmt.Errorf("passphrase is too weak for %s, use %s: %w", KDFHKDF, KDFArgon2id, err)
+		}
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, passphrase, p.Salt, []byte(kdfInfo)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unknown key derivation %q", p.Algorithm)
+	}
+}
+
+// minKeyEntropyBits is the least entropy checkEntropy accepts, estimated from
+// the byte frequencies.
+const minKeyEntropyBits = 128
+
+var ErrWeakKey = errors.New("key has too little entropy")
+
+// checkEntropy rejects secrets that are obviously not random: too few
+// distinct bytes, runs like "abcdefgh" or "00000000", or too little entropy
+// by byte frequency. It can't prove a key random, only catch keys typed by a
+// person or left at a placeholder; random 32-byte keys always pass.
+func checkEntropy(secret []byte) error {
+	counts := map[byte]int{}
+	for _, b := range secret {
+		counts[b]++
+	}
+	if len(counts) < len(secret)/2 {
+		return fmt.Errorf("%w: only %d distinct bytes in %d", ErrWeakKey, len(counts), len(secret))
+	}
+
+	run := 1
+	for i := 2; i < len(secret); i++ {
+		if int(secret[i])-int(secret[i-1]) == int(secret[i-1])-int(secret[i-2]) {
+			run++
+			if run >= 8 {
+				return fmt.Errorf("%w: it contains a sequence of %d evenly spaced bytes", ErrWeakKey, run+1)
+			}
+		} else {
+			run = 1
+		}
+	}
+
+	bits := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(secret))
+		bits -= p * math.Log2(p)
+	}
+	if estimate := bits * float64(len(secret)); estimate < minKeyEntropyBits {
+		return fmt.Errorf("%w: about %.0f bits, want at least %d", ErrWeakKey, estimate, minKeyEntropyBits)
+	}
+	return nil
+}
+
+// checkKeyringEntropy runs checkEntropy on every key of keyring.
+func checkKeyringEntropy(name string, keyring *Keyring) error {
+	if keyring == nil {
+		return nil
+	}
+	for _, key := range keyring.Keys() {
+		if err := checkEntropy(key.Material); err != nil {
+			return fmt.Errorf("%s key %q: %w", name, key.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyMaterial(t *testing.T) {
+	key := []byte{0xfb, 0xff, 0x01, 0x02, 0x03}
+	for _, tc := range []struct {
+		in   string
+		want []byte
+		ok   bool
+	}{
+		{"base64:+/8BAgM=", key, true},
+		{"base64:+/8BAgM", key, true},
+		{"base64:-_8BAgM", key, true},
+		{"hex:fbff010203", key, true},
+		{"hex:FBFF010203", key, true},
+		{"plain text key", []byte("plain text key"), true},
+		{"base64:not base64!", nil, false},
+		{"hex:xyz", nil, false},
+	} {
+		got, err := ParseKeyMaterial(tc.in)
+		if (err == nil) != tc.ok || (tc.ok && !bytes.Equal(got, tc.want)) {
+			t.Errorf("ParseKeyMaterial(%q) = %x, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestKDFParamsRoundTrip(t *testing.T) {
+	params, err := NewKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hkdfParams := KDFParams{Algorithm: KDFHKDF, Salt: params.Salt}
+	for _, p := range []KDFParams{params, hkdfParams} {
+		parsed, err := ParseKDFParams(p.String())
+		if err != nil {
+			t.Fatalf("ParseKDFParams(%q): %v", p, err)
+		}
+		if parsed.String() != p.String() || !bytes.Equal(parsed.Salt, p.Salt) {
+			t.Errorf("ParseKDFParams(%q) = %q", p, parsed)
+		}
+	}
+	if !strings.HasPrefix(params.String(), "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Errorf("NewKDFParams = %q", params)
+	}
+
+	salt := "$AAAAAAAAAAAAAAAAAAAAAA"
+	for _, bad := range []string{
+		"$argon2id$v=16$m=65536,t=3,p=4" + salt,
+		"$argon2id$v=19$m=1024,t=3,p=4" + salt,
+		"$argon2id$v=19$m=65536,t=1,p=4" + salt,
+		"$argon2id$v=19$m=65536,t=3,p=0" + salt,
+		"$argon2id$v=19$m=65536,t=3,p=256" + salt,
+		"$argon2id$v=19$m=65536,t=3,p=4$AAAA",
+		"$hkdf-sha256$AAAA",
+		"$hkdf-sha256$not base64!",
+		"$scrypt$n=16384" + salt,
+		"",
+	} {
+		if _, err := ParseKDFParams(bad); err == nil {
+			t.Errorf("ParseKDFParams(%q) accepted invalid parameters", bad)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	salt := bytes.Repeat([]byte{1}, minKDFSaltBytes)
+	otherSalt := bytes.Repeat([]byte{2}, minKDFSaltBytes)
+	argon := KDFParams{Algorithm: KDFArgon2id, Salt: salt, Memory: minArgon2Memory, Time: minArgon2Time, Threads: 1}
+	passphrase := []byte("correct horse battery staple")
+
+	first, err := argon.DeriveKey(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := argon.DeriveKey(passphrase)
+	argon.Salt = otherSalt
+	salted, _ := argon.DeriveKey(passphrase)
+	if len(first) != 32 || !bytes.Equal(first, second) || bytes.Equal(first, salted) {
+		t.Errorf("argon2id keys %x, %x and %x: want the same key for the same salt only", first, second, salted)
+	}
+	if _, err := argon.DeriveKey([]byte("short")); err == nil {
+		t.Error("argon2id accepted a short passphrase")
+	}
+
+	hkdfParams := KDFParams{Algorithm: KDFHKDF, Salt: salt}
+	if _, err := hkdfParams.DeriveKey(passphrase); !errors.Is(err, ErrWeakKey) {
+		t.Errorf("hkdf with a human passphrase = %v, want ErrWeakKey", err)
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	key, err := hkdfParams.DeriveKey(random)
+	if err != nil || len(key) != 32 {
+		t.Errorf("hkdf with a random secret = %x, %v", key, err)
+	}
+
+	if _, err := (KDFParams{Algorithm: KDFHKDF, Salt: salt[:8]}).DeriveKey(random); err == nil {
+		t.Error("DeriveKey accepted a short salt")
+	}
+}
+
+func TestCheckEntropy(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkEntropy(random); err != nil {
+			t.Fatalf("random key %x rejected: %v", random, err)
+		}
+	}
+
+	for name, weak := range map[string][]byte{
+		"zeros":     make([]byte, 32),
+		"repeated":  []byte(strings.Repeat("ab", 16)),
+		"sequence":  []byte("abcdefghijklmnopqrstuvwxyz012345"),
+		"countdown": []byte("zyxwvutsrqponmlk9f2Kd8s7Qp1Lm3Nx"),
+		"short":     []byte("Kq8#vZ2!"),
+	} {
+		if err := checkEntropy(weak); !errors.Is(err, ErrWeakKey) {
+			t.Errorf("%s key %q = %v, want ErrWeakKey", name, weak, err)
+		}
+	}
+}
+
+func TestNewCryptoMiddlewareRejectsWeakKeys(t *testing.T) {
+	weak, err := NewKeyring(Key{ID: "transport-1", Material: []byte(strings.Repeat("0123456789abcdef", 2)), Status: KeyPrimary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewCryptoMiddleware(staticKeyProvider{&KeySet{Keyring: weak, IV: []byte("0123456789abcdef")}}, ModeGCM)
+	if !errors.Is(err, ErrWeakKey) {
+		t.Errorf("NewCryptoMiddleware with a weak key = %v, want ErrWeakKey", err)
+	}
+}
+
+func TestEnvKeyProviderPassphrase(t *testing.T) {
+	t.Setenv("AES_KEYS", "")
+	t.Setenv("AES_KEY_ID", "")
+	t.Setenv("AES_KDF", "")
+	t.Setenv("AES_PASSPHRASE", "correct horse battery staple")
+	t.Setenv("AES_IV", "0123456789abcdef")
+	if _, err := (EnvKeyProvider{}).LoadKeys(); err == nil || !strings.Contains(err.Error(), "AES_KDF") {
+		t.Errorf("LoadKeys without AES_KDF = %v", err)
+	}
+
+	params := KDFParams{Algorithm: KDFArgon2id, Salt: bytes.Repeat([]byte{1}, minKDFSaltBytes), Memory: minArgon2Memory, Time: minArgon2Time, Threads: 1}
+	t.Setenv("AES_KDF", params.String())
+	keys, err := EnvKeyProvider{}.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := params.DeriveKey([]byte("correct horse battery staple"))
+	if got := keys.Keyring.Primary(); got.ID != "default" || !bytes.Equal(got.Material, want) {
+		t.Errorf("primary key %q was not derived from the passphrase", got.ID)
+	}
+}
@@ -0,0 +1,478 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// KeySet is the key material the crypto middleware needs.
+type KeySet struct {
+	Keyring *Keyring
+	IV      []byte // legacy CBC IV
+	// Data holds the keys for data at rest, see DataCipher. It may be nil.
+	Data *Keyring
+	// Index holds the keys for blind indexes, see BlindIndex. It may be nil.
+	Index *Keyring
+	// Session holds the master keys login session keys are derived from, see
+	// IssueSessionKey. Clients never see them. It may be nil.
+	Session *Keyring
+	// HPKE holds the seeds of the HPKE key pairs, see HPKEPublicKeys. Only
+	// the derived public keys are published. It may be nil.
+	HPKE *Keyring
+	// JWE holds the seeds of the ECDH-ES key pairs, see JWKS. Only the derived
+	// public keys are published. It may be nil.
+	JWE *Keyring
+}
+
+// KeyProvider loads key material for the crypto middleware so it never has
+// to know where keys are stored.
+type KeyProvider interface {
+	LoadKeys() (*KeySet, error)
+}
+
+// NewKeyProviderFromEnv picks a provider from KEY_PROVIDER: "env" (default),
+// "file", or "local-kms" for a key file wrapped by the LocalKMS in
+// LOCAL_KMS_FILE.
+func NewKeyProviderFromEnv() (KeyProvider, error) {
+	switch provider := os.Getenv("KEY_PROVIDER"); provider {
+	case "", "env":
+		return EnvKeyProvider{}, nil
+	case "file":
+		path := os.Getenv("AES_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("AES_KEY_FILE environment variable is not set")
+		}
+		return FileKeyProvider{Path: path}, nil
+	case "local-kms":
+		path := os.Getenv("AES_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("AES_KEY_FILE environment variable is not set")
+		}
+		kms, err := LocalKMSFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		// A missing file opens as an empty KMS, which could unwrap nothing
+		if len(kms.KEKIDs()) == 0 {
+			return nil, fmt.Errorf("LOCAL_KMS_FILE %s has no key encryption keys, create one with \"go run . create-kek <id>\"", os.Getenv("LOCAL_KMS_FILE"))
+		}
+		return KMSKeyProvider{KMS: kms, Path: path}, nil
+	default:
+		return nil, fmt.Errorf("unknown KEY_PROVIDER %q", provider)
+	}
+}
+
+// EnvKeyProvider reads AES_KEYS (or a single key with optional AES_KEY_ID,
+// either AES_SECRET_KEY or derived from AES_PASSPHRASE with the KDFParams in
+// AES_KDF) and AES_IV from the environment, and the optional
+// data, index, session, HPKE and JWE keys from AES_DATA_KEYS, AES_INDEX_KEYS, AES_SESSION_KEYS, AES_HPKE_KEYS and
+// AES_JWE_KEYS, in the AES_KEYS format.
+type EnvKeyProvider struct{}
+
+func (EnvKeyProvider) LoadKeys() (*KeySet, error) {
+	keyring, err := keyringFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	iv := os.Getenv("AES_IV")
+	if iv == "" {
+		return nil, fmt.Errorf("AES_IV environment variable is not set")
+	}
+	if len(iv) != 16 {
+		return nil, fmt.Errorf("AES_IV must be exactly 16 characters (got %d characters)", len(iv))
+	}
+
+	keys := &KeySet{Keyring: keyring, IV: []byte(iv)}
+	for _, optional := range []struct {
+		env     string
+		keyring **Keyring
+	}{
+		{"AES_DATA_KEYS", &keys.Data},
+		{"AES_INDEX_KEYS", &keys.Index},
+		{"AES_SESSION_KEYS", &keys.Session},
+		{"AES_HPKE_KEYS", &keys.HPKE},
+		{"AES_JWE_KEYS", &keys.JWE},
+	} {
+		value := os.Getenv(optional.env)
+		if value == "" {
+			continue
+		}
+		if *optional.keyring, err = ParseKeyring(value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", optional.env, err)
+		}
+	}
+	return keys, nil
+}
+
+func keyringFromEnv() (*Keyring, error) {
+	if keys := os.Getenv("AES_KEYS"); keys != "" {
+		keyring, err := ParseKeyring(keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AES_KEYS: %w", err)
+		}
+		return keyring, nil
+	}
+
+	kid := os.Getenv("AES_KEY_ID")
+	if kid == "" {
+		kid = "default"
+	}
+
+	if passphrase := os.Getenv("AES_PASSPHRASE"); passphrase != "" {
+		kdf := os.Getenv("AES_KDF")
+		if kdf == "" {
+			return nil, fmt.Errorf("AES_KDF environment variable is not set, generate it with \"kdf-params\"")
+		}
+		params, err := ParseKDFParams(kdf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AES_KDF: %w", err)
+		}
+		material, err := params.DeriveKey([]byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("invalid AES_PASSPHRASE: %w", err)
+		}
+		return NewKeyring(Key{ID: kid, Material: material, Status: KeyPrimary})
+	}
+
+	key := os.Getenv("AES_SECRET_KEY")
+	if key == "" {
+		return nil, fmt.Errorf("AES_SECRET_KEY environment variable is not set")
+	}
+	material, err := ParseKeyMaterial(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES_SECRET_KEY: %w", err)
+	}
+	if len(material) != 32 {
+		return nil, fmt.Errorf("AES_SECRET_KEY must be exactly 32 bytes (got %d bytes)", len(material))
+	}
+	return NewKeyring(Key{ID: kid, Material: material, Status: KeyPrimary})
+}
+
+// keyFile is the on-disk format shared by FileKeyProvider and KMSKeyProvider:
+//
+//	{
+//	  "iv": "<16 characters>",
+//	  "keys": [{"id": "2025-06", "status": "primary", "key": "<base64>"}],
+//	  "data_keys": [{"id": "data-2025-06", "status": "primary", "key": "<base64>"}],
+//	  "index_keys": [{"id": "index-2025-06", "status": "primary", "key": "<base64>"}],
+//	  "session_keys": [{"id": "session-2025-06", "status": "primary", "key": "<base64>"}],
+//	  "hpke_keys": [{"id": "hpke-2025-06", "status": "primary", "key": "<base64>"}],
+//	  "jwe_keys": [{"id": "jwe-2025-06", "status": "primary", "key": "<base64>"}]
+//	}
+//
+// For FileKeyProvider "key" is the raw key, base64 encoded. For
+// KMSKeyProvider it is the key wrapped by the KMS key named in "kek_id".
+// "data_keys", "index_keys", "session_keys", "hpke_keys" and "jwe_keys" are
+// optional.
+type keyFile struct {
+	IV          string         `json:"iv"`
+	Keys        []keyFileEntry `json:"keys"`
+	DataKeys    []keyFileEntry `json:"data_keys,omitempty"`
+	IndexKeys   []keyFileEntry `json:"index_keys,omitempty"`
+	SessionKeys []keyFileEntry `json:"session_keys,omitempty"`
+	HPKEKeys    []keyFileEntry `json:"hpke_keys,omitempty"`
+	JWEKeys     []keyFileEntry `json:"jwe_keys,omitempty"`
+}
+
+// loadOptional builds the optional keyrings the file has with load.
+func (f *keyFile) loadOptional(keys *KeySet, load func([]keyFileEntry) (*Keyring, error)) error {
+	for _, optional := range []struct {
+		entries []keyFileEntry
+		keyring **Keyring
+	}{
+		{f.DataKeys, &keys.Data},
+		{f.IndexKeys, &keys.Index},
+		{f.SessionKeys, &keys.Session},
+		{f.HPKEKeys, &keys.HPKE},
+		{f.JWEKeys, &keys.JWE},
+	} {
+		if len(optional.entries) == 0 {
+			continue
+		}
+		var err error
+		if *optional.keyring, err = load(optional.entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type keyFileEntry struct {
+	ID     string    `json:"id"`
+	Status KeyStatus `json:"status"`
+	Key    string    `json:"key"`
+	KEKID  string    `json:"kek_id,omitempty"`
+}
+
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid key file %s: %w", path, err)
+	}
+	if len(file.IV) != 16 {
+		return nil, fmt.Errorf("key file %s: iv must be exactly 16 characters (got %d characters)", path, len(file.IV))
+	}
+	return &file, nil
+}
+
+// readPrivateFile reads a file holding key material, refusing it unless only
+// its owner can access it.
+func readPrivateFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("key file %s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("key file %s must not be accessible by group or others (mode %04o, want 0600 or 0400)", path, perm)
+	}
+	return os.ReadFile(path)
+}
+
+// FileKeyProvider reads keys from a JSON key file that must only be readable by its owner.
+type FileKeyProvider struct {
+	Path string
+}
+
+func (p FileKeyProvider) LoadKeys() (*KeySet, error) {
+	file, err := readKeyFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := p.keyring(file.Keys)
+	if err != nil {
+		return nil, err
+	}
+	keys := &KeySet{Keyring: keyring, IV: []byte(file.IV)}
+	if err := file.loadOptional(keys, p.keyring); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (p FileKeyProvider) keyring(entries []keyFileEntry) (*Keyring, error) {
+	keys := make([]Key, 0, len(entries))
+	for _, k := range entries {
+		material, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: key %q is not valid base64: %w", p.Path, k.ID, err)
+		}
+		keys = append(keys, Key{ID: k.ID, Status: k.Status, Material: material})
+	}
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", p.Path, err)
+	}
+	return keyring, nil
+}
+
+// KMS wraps and unwraps data keys with key encryption keys that never leave it.
+type KMS interface {
+	Encrypt(ctx context.Context, kekID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, kekID string, ciphertext []byte) ([]byte, error)
+}
+
+// KMSKeyProvider reads a key file whose keys are wrapped by a KMS, so the
+// file alone is useless to whoever copies it.
+type KMSKeyProvider struct {
+	KMS  KMS
+	Path string
+}
+
+func (p KMSKeyProvider) LoadKeys() (*KeySet, error) {
+	file, err := readKeyFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := p.keyring(file.Keys)
+	if err != nil {
+		return nil, err
+	}
+	keys := &KeySet{Keyring: keyring, IV: []byte(file.IV)}
+	if err := file.loadOptional(keys, p.keyring); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (p KMSKeyProvider) keyring(entries []keyFileEntry) (*Keyring, error) {
+	keys := make([]Key, 0, len(entries))
+	for _, k := range entries {
+		if k.KEKID == "" {
+			return nil, fmt.Errorf("key file %s: key %q has no kek_id", p.Path, k.ID)
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: key %q is not valid base64: %w", p.Path, k.ID, err)
+		}
+		material, err := p.KMS.Decrypt(context.Background(), k.KEKID, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key %q: %w", k.ID, err)
+		}
+		keys = append(keys, Key{ID: k.ID, Status: k.Status, Material: material})
+	}
+	keyring, err := NewKeyring(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", p.Path, err)
+	}
+	return keyring, nil
+}
+
+// WrapKeyFile wraps every key in the key file at path with the KMS key
+// kekID, turning a file for FileKeyProvider into one for KMSKeyProvider.
+// Keys already wrapped with another KEK are rewrapped, so it is also how a
+// KEK is rotated; once it returns, the old KEK can be disabled. The file is
+// replaced in one step. It returns the number of keys written.
+func WrapKeyFile(ctx context.Context, kms KMS, path, kekID string) (int, error) {
+	file, err := readKeyFile(path)
+	if err != nil {
+		return 0, err
+	}
+	wrapped := 0
+	for _, entries := range [][]keyFileEntry{
+		file.Keys, file.DataKeys, file.IndexKeys, file.SessionKeys,
+		file.HPKEKeys, file.JWEKeys,
+	} {
+		for i := range entries {
+			entry := &entries[i]
+			if entry.KEKID == kekID {
+				continue
+			}
+			material, err := base64.StdEncoding.DecodeString(entry.Key)
+			if err != nil {
+				return 0, fmt.Errorf("key file %s: key %q is not valid base64: %w", path, entry.ID, err)
+			}
+			if entry.KEKID != "" {
+				if material, err = kms.Decrypt(ctx, entry.KEKID, material); err != nil {
+					return 0, fmt.Errorf("failed to unwrap key %q: %w", entry.ID, err)
+				}
+			}
+			sealed, err := kms.Encrypt(ctx, kekID, material)
+			clear(material)
+			if err != nil {
+				return 0, fmt.Errorf("failed to wrap key %q: %w", entry.ID, err)
+			}
+			entry.Key, entry.KEKID = base64.StdEncoding.EncodeToString(sealed), kekID
+			wrapped++
+		}
+	}
+	if wrapped == 0 {
+		return 0, nil
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return wrapped, writePrivateFile(path, data)
+}
+
+var ErrUnknownKEK = errors.New("unknown key encryption key")
+
+// FakeKMS is an in-process KMS for tests and local development. Its key
+// encryption keys are random and live only as long as the process; LocalKMS
+// keeps them in a file.
+type FakeKMS struct {
+	mu   sync.RWMutex
+	keks map[string]Key
+}
+
+func NewFakeKMS(kekIDs ...string) (*FakeKMS, error) {
+	kms := &FakeKMS{keks: make(map[string]Key)}
+	for _, id := range kekIDs {
+		if err := kms.CreateKey(id); err != nil {
+			return nil, err
+		}
+	}
+	return kms, nil
+}
+
+// CreateKey adds a new random key encryption key.
+func (f *FakeKMS) CreateKey(kekID string) error {
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		return err
+	}
+	return f.addKey(Key{ID: kekID, Material: material, Status: KeyPrimary})
+}
+
+func (f *FakeKMS) addKey(kek Key) error {
+	if err := validateKeyID(kek.ID); err != nil {
+		return err
+	}
+	if len(kek.Material) != 32 {
+		return fmt.Errorf("key encryption key %q must be exactly 32 bytes (got %d bytes)", kek.ID, len(kek.Material))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.keks[kek.ID]; ok {
+		return fmt.Errorf("key encryption key %q already exists", kek.ID)
+	}
+	f.keks[kek.ID] = kek
+	return nil
+}
+
+func (f *FakeKMS) removeKey(kekID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.keks, kekID)
+}
+
+// keys returns the key encryption keys, sorted by ID.
+func (f *FakeKMS) keys() []Key {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	keys := make([]Key, 0, len(f.keks))
+	for _, kek := range f.keks {
+		keys = append(keys, kek)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+func (f *FakeKMS) Encrypt(_ context.Context, kekID string, plaintext []byte) ([]byte, error) {
+	kek, err := f.kek(kekID)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := sealGCM(kek, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(envelope), nil
+}
+
+func (f *FakeKMS) Decrypt(_ context.Context, kekID string, ciphertext []byte) ([]byte, error) {
+	kek, err := f.kek(kekID)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := NewKeyring(kek)
+	if err != nil {
+		return nil, err
+	}
+	return openEnvelope(keyring, string(ciphertext))
+}
+
+func (f *FakeKMS) kek(kekID string) (Key, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	kek, ok := f.keks[kekID]
+	if !ok {
+		return Key{}, fmt.Errorf("%w: %q", ErrUnknownKEK, kekID)
+	}
+	return kek, nil
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvKeyProvider(t *testing.T) {
+	transport, data := randomKey(t, "t", KeyPrimary), randomKey(t, "d", KeyPrimary)
+	t.Setenv("AES_KEYS", "2025-06:primary:base64:"+base64.StdEncoding.EncodeToString(transport.Material))
+	t.Setenv("AES_DATA_KEYS", "data-1:primary:base64:"+base64.StdEncoding.EncodeToString(data.Material))
+	t.Setenv("AES_IV", "0123456789abcdef")
+
+	keys, err := EnvKeyProvider{}.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys.Keyring.Primary(); got.ID != "2025-06" || !bytes.Equal(got.Material, transport.Material) {
+		t.Errorf("transport primary = %q", got.ID)
+	}
+	if keys.Data == nil || !bytes.Equal(keys.Data.Primary().Material, data.Material) {
+		t.Error("AES_DATA_KEYS was not loaded")
+	}
+	if keys.Index != nil {
+		t.Error("Index keys loaded without AES_INDEX_KEYS")
+	}
+
+	t.Setenv("AES_IV", "short")
+	if _, err := (EnvKeyProvider{}).LoadKeys(); err == nil {
+		t.Error("LoadKeys accepted a short AES_IV")
+	}
+}
+
+func TestEnvKeyProviderSingleKey(t *testing.T) {
+	key := randomKey(t, "k", KeyPrimary)
+	t.Setenv("AES_KEYS", "")
+	t.Setenv("AES_PASSPHRASE", "")
+	t.Setenv("AES_KEY_ID", "")
+	t.Setenv("AES_IV", "0123456789abcdef")
+
+	t.Setenv("AES_SECRET_KEY", "base64:"+base64.StdEncoding.EncodeToString(key.Material))
+	keys, err := EnvKeyProvider{}.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys.Keyring.Primary(); got.ID != "default" || !bytes.Equal(got.Material, key.Material) {
+		t.Errorf("primary = %q", got.ID)
+	}
+
+	t.Setenv("AES_SECRET_KEY", "base64:"+base64.StdEncoding.EncodeToString(key.Material[:16]))
+	if _, err := (EnvKeyProvider{}).LoadKeys(); err == nil {
+		t.Error("LoadKeys accepted a 16 byte AES_SECRET_KEY")
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	transport, transportMaterial := randomKeyEntry(t, "2025-06", KeyPrimary)
+	index, indexMaterial := randomKeyEntry(t, "index-1", KeyPrimary)
+	data, err := json.Marshal(keyFile{IV: "0123456789abcdef", Keys: []keyFileEntry{transport}, IndexKeys: []keyFileEntry{index}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := FileKeyProvider{Path: path}.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.Keyring.Primary().Material, transportMaterial) {
+		t.Error("transport key material differs from the file")
+	}
+	if keys.Index == nil || !bytes.Equal(keys.Index.Primary().Material, indexMaterial) {
+		t.Error("index_keys were not loaded")
+	}
+	if string(keys.IV) != "0123456789abcdef" {
+		t.Errorf("IV = %q", keys.IV)
+	}
+
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (FileKeyProvider{Path: path}).LoadKeys(); err == nil {
+		t.Error("LoadKeys read a key file others can read")
+	}
+}
+
+func TestKMSKeyProvider(t *testing.T) {
+	ctx := context.Background()
+	kms, err := NewFakeKMS("kek-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	entry, material := randomKeyEntry(t, "2025-06", KeyPrimary)
+	writeTestKeyFile(t, path, entry)
+
+	if _, err := (KMSKeyProvider{KMS: kms, Path: path}).LoadKeys(); err == nil {
+		t.Error("LoadKeys accepted a key without kek_id")
+	}
+
+	wrapped, err := kms.Encrypt(ctx, "kek-1", material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Key, entry.KEKID = base64.StdEncoding.EncodeToString(wrapped), "kek-1"
+	writeTestKeyFile(t, path, entry)
+	keys, err := KMSKeyProvider{KMS: kms, Path: path}.LoadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.Keyring.Primary().Material, material) {
+		t.Error("unwrapped key differs from the original")
+	}
+
+	entry.KEKID = "kek-2"
+	writeTestKeyFile(t, path, entry)
+	if _, err := (KMSKeyProvider{KMS: kms, Path: path}).LoadKeys(); !errors.Is(err, ErrUnknownKEK) {
+		t.Errorf("LoadKeys with an unknown KEK = %v, want ErrUnknownKEK", err)
+	}
+}
+
+func TestFakeKMS(t *testing.T) {
+	ctx := context.Background()
+	kms, err := NewFakeKMS("kek-1", "kek-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := kms.Encrypt(ctx, "kek-1", []byte("data key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := kms.Decrypt(ctx, "kek-1", wrapped); err != nil || string(plaintext) != "data key" {
+		t.Errorf("Decrypt = %q, %v", plaintext, err)
+	}
+	if _, err := kms.Decrypt(ctx, "kek-2", wrapped); err == nil {
+		t.Error("Decrypt unwrapped with the wrong KEK")
+	}
+	if _, err := kms.Encrypt(ctx, "kek-3", []byte("data key")); !errors.Is(err, ErrUnknownKEK) {
+		t.Errorf("Encrypt with an unknown KEK = %v, want ErrUnknownKEK", err)
+	}
+	if err := kms.CreateKey("kek-1"); err == nil {
+		t.Error("CreateKey replaced an existing KEK")
+	}
+}
+
+func TestNewKeyProviderFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		provider string
+		file     string
+		want     KeyProvider
+		wantErr  bool
+	}{
+		{provider: "", want: EnvKeyProvider{}},
+		{provider: "env", want: EnvKeyProvider{}},
+		{provider: "file", file: "keys.json", want: FileKeyProvider{Path: "keys.json"}},
+		{provider: "file", wantErr: true},
+		{provider: "vault", wantErr: true},
+	} {
+		t.Setenv("KEY_PROVIDER", tc.provider)
+		t.Setenv("AES_KEY_FILE", tc.file)
+		got, err := NewKeyProviderFromEnv()
+		if (err != nil) != tc.wantErr || (!tc.wantErr && got != tc.want) {
+			t.Errorf("KEY_PROVIDER=%q AES_KEY_FILE=%q: %v, %v", tc.provider, tc.file, got, err)
+		}
+	}
+}
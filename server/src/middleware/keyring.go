@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyStatus controls what a key in a Keyring may be used for.
+type KeyStatus string
+
+const (
+	// KeyPrimary encrypts new values. A keyring has exactly one primary key.
+	KeyPrimary KeyStatus = "primary"
+	// KeyActive decrypts values; it is typically the next primary, staged ahead of a rotation.
+	KeyActive KeyStatus = "active"
+	// KeyRetiring decrypts values produced before a rotation until it is removed.
+	KeyRetiring KeyStatus = "retiring"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key id")
+	ErrNoPrimary  = errors.New("keyring has no primary key")
+)
+
+// Key is a single AES-256 key tagged with the ID recorded in envelopes.
+type Key struct {
+	ID       string
+	Material []byte
+	Status   KeyStatus
+}
+
+// Keyring holds the keys the middleware can use. Encryption always uses the
+// primary key; decryption accepts any key still in the ring.
+//
+// A zero-downtime rotation is: Add the new key as active, Promote it once
+// every instance has it, then Remove the old key once its ciphertexts age out.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string]Key
+	primary string
+	// validate vets keys added at runtime, see CryptoMiddleware.checkKeyrings
+	validate func(Key) error
+}
+
+func NewKeyring(keys ...Key) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]Key)}
+	for _, key := range keys {
+		if key.Status == KeyPrimary && k.primary != "" {
+			return nil, fmt.Errorf("keyring has more than one primary key (%q and %q)", k.primary, key.ID)
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		if err := k.add(key); err != nil {
+			return nil, err
+		}
+	}
+	if k.primary == "" {
+		return nil, ErrNoPrimary
+	}
+	return k, nil
+}
+
+// Primary returns the key used to encrypt new values.
+func (k *Keyring) Primary() Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[k.primary]
+}
+
+// Lookup returns the key with the given ID for decryption.
+func (k *Keyring) Lookup(id string) (Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return Key{}, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Add stages a new key. Adding a primary key demotes the current primary to
+// retiring. The ID and material must be new: replacing a key's material would
+// leave everything encrypted under it undecryptable.
+func (k *Keyring) Add(key Key) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, existing := range k.keys {
+		if existing.ID == key.ID {
+			return fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		if bytes.Equal(existing.Material, key.Material) {
+			return fmt.Errorf("key %q must not reuse the key %q", key.ID, existing.ID)
+		}
+	}
+	if k.validate != nil {
+		if err := k.validate(key); err != nil {
+			return err
+		}
+	}
+	return k.add(key)
+}
+
+// setValidator installs the checks Add runs on new keys.
+func (k *Keyring) setValidator(validate func(Key) error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.validate = validate
+}
+
+// Promote makes id the primary key and moves the previous primary to retiring.
+func (k *Keyring) Promote(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	key.Status = KeyPrimary
+	return k.add(key)
+}
+
+// Remove drops a key so its ciphertexts are no longer accepted. The primary key cannot be removed.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	if id == k.primary {
+		return fmt.Errorf("cannot remove primary key %q", id)
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+// Keys returns a snapshot of the ring sorted by key ID.
+func (k *Keyring) Keys() []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys := make([]Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+func (k *Keyring) add(key Key) error {
+	if err := validateKeyID(key.ID); err != nil {
+		return err
+	}
+	if len(key.Material) != 32 {
+		return fmt.Errorf("key %q must be exactly 32 bytes (got %d bytes)", key.ID, len(key.Material))
+	}
+	switch key.Status {
+	case KeyPrimary:
+		if k.primary != "" && k.primary != key.ID {
+			previous := k.keys[k.primary]
+			previous.Status = KeyRetiring
+			k.keys[previous.ID] = previous
+		}
+		k.primary = key.ID
+	case KeyActive, KeyRetiring:
+		if k.primary == key.ID {
+			return fmt.Errorf("cannot demote primary key %q, promote another key first", key.ID)
+		}
+	default:
+		return fmt.Errorf("key %q has unknown status %q", key.ID, key.Status)
+	}
+	k.keys[key.ID] = key
+	return nil
+}
+
+// validateKeyID keeps key IDs safe to embed in the "v2:<kid>:<ciphertext>" envelope.
+func validateKeyID(id string) error {
+	if id == "" {
+		return errors.New("key id must not be empty")
+	}
+	if strings.ContainsAny(id, ":,= \t\n") {
+		return fmt.Errorf("key id %q must not contain ':', ',', '=' or whitespace", id)
+	}
+	return nil
+}
+
+// ParseKeyring parses AES_KEYS-style entries of the form "kid:status:key",
+// separated by commas, e.g. "2025-06:primary:base64:<key>,2025-01:retiring:hex:<key>".
+// Keys are decoded with ParseKeyMaterial.
+func ParseKeyring(s string) (*Keyring, error) {
+	var keys []Key
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid key entry %q, expected kid:status:key", entry)
+		}
+		material, err := ParseKeyMaterial(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", parts[0], err)
+		}
+		keys = append(keys, Key{
+			ID:       parts[0],
+			Status:   KeyStatus(parts[1]),
+			Material: material,
+		})
+	}
+	return NewKeyring(keys...)
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	keyring := randomKeyring(t, "key-1")
+	old, err := sealGCM(keyring.Primary(), []byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stage, promote, then remove the old key
+	if err := keyring.Add(randomKey(t, "key-2", KeyActive)); err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Primary().ID != "key-1" {
+		t.Fatalf("primary after staging = %q, want key-1", keyring.Primary().ID)
+	}
+	if err := keyring.Promote("key-2"); err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Primary().ID != "key-2" {
+		t.Fatalf("primary after promoting = %q, want key-2", keyring.Primary().ID)
+	}
+	if previous, _ := keyring.Lookup("key-1"); previous.Status != KeyRetiring {
+		t.Errorf("key-1 status = %q, want %q", previous.Status, KeyRetiring)
+	}
+	if plaintext, err := openEnvelope(keyring, old); err != nil || string(plaintext) != "before" {
+		t.Errorf("envelope from before the rotation = %q, %v", plaintext, err)
+	}
+
+	if err := keyring.Remove("key-2"); err == nil {
+		t.Error("Remove accepted the primary key")
+	}
+	if err := keyring.Remove("key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openEnvelope(keyring, old); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("envelope of a removed key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestNewKeyringRejects(t *testing.T) {
+	a, b := randomKey(t, "a", KeyPrimary), randomKey(t, "b", KeyPrimary)
+	for _, tc := range []struct {
+		name string
+		keys []Key
+	}{
+		{"no primary", []Key{{ID: "a", Material: a.Material, Status: KeyActive}}},
+		{"two primaries", []Key{a, b}},
+		{"duplicate id", []Key{a, {ID: "a", Material: b.Material, Status: KeyActive}}},
+		{"short key", []Key{{ID: "a", Material: a.Material[:16], Status: KeyPrimary}}},
+		{"colon in id", []Key{{ID: "a:b", Material: a.Material, Status: KeyPrimary}}},
+		{"unknown status", []Key{a, {ID: "b", Material: b.Material, Status: "spare"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewKeyring(tc.keys...); err == nil {
+				t.Error("NewKeyring accepted the keys")
+			}
+		})
+	}
+}
+
+func TestKeyringAddRejectsReuse(t *testing.T) {
+	keyring := randomKeyring(t, "key-1")
+	if err := keyring.Add(randomKey(t, "key-1", KeyActive)); err == nil {
+		t.Error("Add replaced an existing key ID")
+	}
+	if err := keyring.Add(Key{ID: "key-2", Material: keyring.Primary().Material, Status: KeyActive}); err == nil {
+		t.Error("Add accepted the material of another key")
+	}
+}
+
+func TestMiddlewareVetsRuntimeKeys(t *testing.T) {
+	m := newTestMiddleware(t, func(keys *KeySet) {
+		keys.Data = randomKeyring(t, "data-1")
+	})
+	if err := m.Keyring().Add(Key{ID: "typed", Material: []byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"), Status: KeyActive}); err == nil {
+		t.Error("Add accepted a low-entropy key")
+	}
+	if err := m.Keyring().Add(Key{ID: "copy", Material: m.data.Primary().Material, Status: KeyActive}); err == nil {
+		t.Error("Add accepted a data key as a transport key")
+	}
+	if err := m.Keyring().Add(randomKey(t, "data-1", KeyActive)); err == nil {
+		t.Error("Add accepted the ID of a data key")
+	}
+	if err := m.Keyring().Add(randomKey(t, "transport-2", KeyActive)); err != nil {
+		t.Errorf("Add rejected a fresh random key: %v", err)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	first, second := randomKey(t, "x", KeyPrimary), randomKey(t, "y", KeyPrimary)
+	keyring, err := ParseKeyring("2025-06:primary:base64:" + base64.StdEncoding.EncodeToString(first.Material) +
+		", 2025-01:retiring:hex:" + hex.EncodeToString(second.Material))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keyring.Primary(); got.ID != "2025-06" || !bytes.Equal(got.Material, first.Material) {
+		t.Errorf("primary = %q", got.ID)
+	}
+	if got, err := keyring.Lookup("2025-01"); err != nil || got.Status != KeyRetiring || !bytes.Equal(got.Material, second.Material) {
+		t.Errorf("2025-01 = %+v, %v", got.Status, err)
+	}
+	if _, err := ParseKeyring("2025-06:primary"); err == nil {
+		t.Error("ParseKeyring accepted an entry without a key")
+	}
+}
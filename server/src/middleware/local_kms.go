@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// LocalKMS is a KMS whose key encryption keys live in a JSON file that only
+// its owner may read:
+//
+//	{"keks": [{"id": "kek-2025-06", "key": "<base64 of 32 bytes>"}]}
+//
+// It stands in for a cloud KMS in development and tests. Unlike one, it
+// hands the process the key encryption keys, so it protects nothing against
+// whoever can read the file.
+type LocalKMS struct {
+	path string
+	mu   sync.Mutex // serializes writes of the file
+	keks *FakeKMS
+}
+
+type localKMSFile struct {
+	KEKs []localKMSEntry `json:"keks"`
+}
+
+type localKMSEntry struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// OpenLocalKMS loads the key encryption keys in path. A missing file is an
+// empty KMS, created on the first CreateKey.
+func OpenLocalKMS(path string) (*LocalKMS, error) {
+	kms := &LocalKMS{path: path, keks: &FakeKMS{keks: make(map[string]Key)}}
+	data, err := readPrivateFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return kms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file localKMSFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid KMS file %s: %w", path, err)
+	}
+	for _, entry := range file.KEKs {
+		material, err := base64.StdEncoding.DecodeString(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("KMS file %s: key %q is not valid base64: %w", path, entry.ID, err)
+		}
+		if err := kms.keks.addKey(Key{ID: entry.ID, Material: material, Status: KeyPrimary}); err != nil {
+			return nil, fmt.Errorf("KMS file %s: %w", path, err)
+		}
+	}
+	return kms, nil
+}
+
+// LocalKMSFromEnv opens the LocalKMS in LOCAL_KMS_FILE.
+func LocalKMSFromEnv() (*LocalKMS, error) {
+	path := os.Getenv("LOCAL_KMS_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("LOCAL_KMS_FILE environment variable is not set")
+	}
+	return OpenLocalKMS(path)
+}
+
+// KEKIDs returns the IDs of the key encryption keys, sorted.
+func (l *LocalKMS) KEKIDs() []string {
+	keks := l.keks.keys()
+	ids := make([]string, 0, len(keks))
+	for _, kek := range keks {
+		ids = append(ids, kek.ID)
+	}
+	return ids
+}
+
+// CreateKey adds a new random key encryption key and saves the file.
+func (l *LocalKMS) CreateKey(kekID string) error {
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.keks.addKey(Key{ID: kekID, Material: material, Status: KeyPrimary}); err != nil {
+		return err
+	}
+	if err := l.save(); err != nil {
+		l.keks.removeKey(kekID)
+		return err
+	}
+	return nil
+}
+
+// save writes the key encryption keys to the file.
+func (l *LocalKMS) save() error {
+	var file localKMSFile
+	for _, kek := range l.keks.keys() {
+		file.KEKs = append(file.KEKs, localKMSEntry{ID: kek.ID, Key: base64.StdEncoding.EncodeToString(kek.Material)})
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(l.path, data)
+}
+
+// writePrivateFile replaces path with data through a temporary file, so a
+// crash never leaves it half written.
+func writePrivateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	// CreateTemp already uses 0600, the mode readPrivateFile insists on
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *LocalKMS) Encrypt(ctx context.Context, kekID string, plaintext []byte) ([]byte, error) {
+	return l.keks.Encrypt(ctx, kekID, plaintext)
+}
+
+func (l *LocalKMS) Decrypt(ctx context.Context, kekID string, ciphertext []byte) ([]byte, error) {
+	return l.keks.Decrypt(ctx, kekID, ciphertext)
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestKeyFile(t *testing.T, path string, keys ...keyFileEntry) {
+	t.Helper()
+	data, err := json.Marshal(keyFile{IV: "0123456789abcdef", Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func randomKeyEntry(t *testing.T, id string, status KeyStatus) (keyFileEntry, []byte) {
+	t.Helper()
+	material := make([]byte, 32)
+	if _, err := rand.Read(material); err != nil {
+		t.Fatal(err)
+	}
+	return keyFileEntry{ID: id, Status: status, Key: base64.StdEncoding.EncodeToString(material)}, material
+}
+
+func TestLocalKMSPersistsKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kms.json")
+	kms, err := OpenLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.CreateKey("kek-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.CreateKey("kek-1"); err == nil {
+		t.Error("CreateKey accepted a duplicate key ID")
+	}
+	wrapped, err := kms.Encrypt(context.Background(), "kek-1", []byte("data key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenLocalKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := reopened.Decrypt(context.Background(), "kek-1", wrapped)
+	if err != nil || string(plaintext) != "data key" {
+		t.Errorf("Decrypt after reopening = %q, %v", plaintext, err)
+	}
+}
+
+func TestWrapKeyFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "keys.json")
+	primary, primaryMaterial := randomKeyEntry(t, "key-1", KeyPrimary)
+	active, activeMaterial := randomKeyEntry(t, "key-2", KeyActive)
+	writeTestKeyFile(t, keyPath, primary, active)
+
+	kms, err := OpenLocalKMS(filepath.Join(dir, "kms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"kek-1", "kek-2"} {
+		if err := kms.CreateKey(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertKeys := func(kekID string) {
+		t.Helper()
+		file, err := readKeyFile(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range file.Keys {
+			if entry.KEKID != kekID {
+				t.Errorf("key %q wrapped with %q, want %q", entry.ID, entry.KEKID, kekID)
+			}
+		}
+		keys, err := KMSKeyProvider{KMS: kms, Path: keyPath}.LoadKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keys.Keyring.Primary(); got.ID != "key-1" || !bytes.Equal(got.Material, primaryMaterial) {
+			t.Errorf("primary key = %q, want key-1 with its original material", got.ID)
+		}
+		if got, err := keys.Keyring.Lookup("key-2"); err != nil || !bytes.Equal(got.Material, activeMaterial) {
+			t.Errorf("key-2 lost its original material: %v", err)
+		}
+	}
+
+	wrapped, err := WrapKeyFile(ctx, kms, keyPath, "kek-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped != 2 {
+		t.Errorf("WrapKeyFile = %d, want 2", wrapped)
+	}
+	assertKeys("kek-1")
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("key file mode after wrapping = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// Rotation: rewrap with kek-2, then drop kek-1
+	if wrapped, err := WrapKeyFile(ctx, kms, keyPath, "kek-2"); err != nil || wrapped != 2 {
+		t.Fatalf("rewrapping = %d, %v, want 2, nil", wrapped, err)
+	}
+	kms.keks.removeKey("kek-1")
+	assertKeys("kek-2")
+	if wrapped, err := WrapKeyFile(ctx, kms, keyPath, "kek-2"); err != nil || wrapped != 0 {
+		t.Errorf("rewrapping again = %d, %v, want 0, nil", wrapped, err)
+	}
+}
+
+func TestLocalKMSProviderRequiresKeys(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KEY_PROVIDER", "local-kms")
+	t.Setenv("AES_KEY_FILE", filepath.Join(dir, "keys.json"))
+	t.Setenv("LOCAL_KMS_FILE", filepath.Join(dir, "kms.json"))
+
+	_, err := NewKeyProviderFromEnv()
+	if err == nil || !strings.Contains(err.Error(), "no key encryption keys") {
+		t.Fatalf("NewKeyProviderFromEnv with a missing KMS file = %v, want an error", err)
+	}
+
+	kms, err := LocalKMSFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.CreateKey("kek-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyProviderFromEnv(); err != nil {
+		t.Errorf("NewKeyProviderFromEnv with a KEK = %v", err)
+	}
+}
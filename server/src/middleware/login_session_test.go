@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginSessionBoundToUser(t *testing.T) {
+	m := newTestMiddleware(t, func(keys *KeySet) {
+		keys.Session = randomKeyring(t, "session-1")
+	})
+	r := newTestRouter(m, func(c *gin.Context) {
+		user, _ := SessionUser(c)
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{"user": user}})
+	})
+	session, err := m.IssueSessionKey("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(r, http.MethodGet, "/api/v1/profile", "", "", http.Header{SessionHeader: {session.ID}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	sessionKeys, err := NewKeyring(Key{ID: session.ID, Material: session.Key, Status: KeyPrimary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := mustOpen(t, sessionKeys, responseData(t, w).(map[string]interface{})["user"]); user != "user-1" {
+		t.Errorf("SessionUser = %v, want user-1", user)
+	}
+
+	// A session whose user was changed in the store is refused
+	tampered := *session
+	tampered.ID, tampered.UserID = "tampered", "user-2"
+	if err := m.sessions.Put(&tampered); err != nil {
+		t.Fatal(err)
+	}
+	w = serve(r, http.MethodGet, "/api/v1/profile", "", "", http.Header{SessionHeader: {tampered.ID}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("tampered session status = %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+	}
+}
+
+func TestLoginSessionSurvivesMasterRotation(t *testing.T) {
+	m := newTestMiddleware(t, func(keys *KeySet) {
+		keys.Session = randomKeyring(t, "session-1")
+	})
+	session, err := m.IssueSessionKey("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.master.Add(randomKey(t, "session-2", KeyPrimary)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkSessionUser(session); err != nil {
+		t.Errorf("session issued by a demoted master key: %v", err)
+	}
+	if err := m.master.Remove("session-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkSessionUser(session); !errors.Is(err, ErrSessionUser) {
+		t.Errorf("session issued by a removed master key = %v, want ErrSessionUser", err)
+	}
+}
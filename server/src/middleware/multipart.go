@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartMemory matches gin's default MaxMultipartMemory: larger files are
+// spooled to temporary files while the form is parsed.
+const multipartMemory = 32 << 20
+
+var errFormParsed = errors.New("multipart form already parsed")
+
+// decryptMultipart decrypts a multipart/form-data request the way the Flutter
+// client's EncryptionInterceptor encrypts FormData: every text field is an
+// encrypted value, files are sent as they are. A file part may also be
+// encrypted by sending it with Content-Type StreamContentType, in which case
+// it is decrypted and gets the content type from its "type" parameter.
+//
+// The parts are decrypted into a new multipart body which is parsed here, so
+// c.PostForm and c.FormFile see the plaintext and decryption errors are
+// reported before the handler runs. On routes where request encryption is
+// optional, text fields that don't decrypt are kept as they are; elsewhere at
+// least one part must be encrypted. It reports whether any part was encrypted.
+func (m *CryptoMiddleware) decryptMultipart(c *gin.Context, policy Policy) (bool, error) {
+	_, params, err := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return false, fmt.Errorf("missing multipart boundary")
+	}
+	source := multipart.NewReader(http.MaxBytesReader(c.Writer, c.Request.Body, m.maxStreamBytes), params["boundary"])
+
+	pr, pw := io.Pipe()
+	target := multipart.NewWriter(pw)
+	done := make(chan error, 1)
+	encrypted := false
+	go func() {
+		var err error
+		encrypted, err = m.copyDecryptedParts(source, target, policy)
+		if err == nil {
+			err = target.Close()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	c.Request.Header.Set("Content-Type", target.FormDataContentType())
+	c.Request.ContentLength = -1
+	c.Request.Body = pr
+	parseErr := c.Request.ParseMultipartForm(multipartMemory)
+	// Unblock the writer if parsing stopped early
+	pr.CloseWithError(errFormParsed)
+	// A decryption error is what made parsing fail, so it is the one to report
+	if err := <-done; err != nil && !errors.Is(err, errFormParsed) {
+		return false, err
+	}
+	if parseErr != nil {
+		return false, parseErr
+	}
+	// A form of plaintext files alone has nothing encrypted in it
+	if !encrypted && policy.Request != EncryptionOptional {
+		return false, fmt.Errorf("form has no encrypted fields or files")
+	}
+	return encrypted, nil
+}
+
+func (m *CryptoMiddleware) copyDecryptedParts(source *multipart.Reader, target *multipart.Writer, policy Policy) (bool, error) {
+	encrypted := false
+	for {
+		part, err := source.NextPart()
+		if err == io.EOF {
+			return encrypted, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		header := make(map[string][]string, len(part.Header))
+		for name, values := range part.Header {
+			header[name] = values
+		}
+		delete(header, "Content-Length")
+
+		if part.FileName() == "" {
+			decrypted, err := m.copyField(part, target, header, policy)
+			if err != nil {
+				return false, err
+			}
+			encrypted = encrypted || decrypted
+			continue
+		}
+
+		var content io.Reader = part
+		if ok, plainType := streamContentType(part.Header.Get("Content-Type")); ok {
+			reader, err := newStreamReader(part, m.keyring)
+			if err != nil {
+				return false, fmt.Errorf("file %s: %w", part.FormName(), err)
+			}
+			content = reader
+			header["Content-Type"] = []string{plainType}
+			encrypted = true
+		}
+		writer, err := target.CreatePart(header)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(writer, content); err != nil {
+			return false, fmt.Errorf("file %s: %w", part.FormName(), err)
+		}
+	}
+}
+
+// copyField writes the plaintext of a text field and reports whether it was encrypted.
+func (m *CryptoMiddleware) copyField(part *multipart.Part, target *multipart.Writer, header map[string][]string, policy Policy) (bool, error) {
+	// Text fields are buffered in memory by ParseMultipartForm anyway
+	value, err := io.ReadAll(io.LimitReader(part, m.maxBodyBytes+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(value)) > m.maxBodyBytes {
+		return false, fmt.Errorf("field %s exceeds %d bytes", part.FormName(), m.maxBodyBytes)
+	}
+
+	decrypted := true
+	plain, err := m.decryptScalar(string(value))
+	if err != nil {
+		if policy.Request != EncryptionOptional {
+			return false, fmt.Errorf("field %s: %w", part.FormName(), err)
+		}
+		plain, decrypted = string(value), false
+	}
+	writer, err := target.CreatePart(header)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.WriteString(writer, plain)
+	return decrypted, err
+}
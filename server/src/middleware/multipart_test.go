@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type formPart struct {
+	name, filename, contentType string
+	content                     []byte
+}
+
+func multipartBody(t *testing.T, parts ...formPart) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		disposition := map[string]string{"name": part.name}
+		if part.filename != "" {
+			disposition["filename"] = part.filename
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", disposition))
+		if part.contentType != "" {
+			header.Set("Content-Type", part.contentType)
+		}
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(part.content)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writer.FormDataContentType(), body.String()
+}
+
+// echoForm responds with the "name" field and the "file" upload the handler sees.
+func echoForm(c *gin.Context) {
+	data := gin.H{"name": c.PostForm("name")}
+	if header, err := c.FormFile("file"); err == nil {
+		file, err := header.Open()
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		defer file.Close()
+		content, _ := io.ReadAll(file)
+		data["file"] = string(content)
+		data["fileType"] = header.Header.Get("Content-Type")
+	}
+	c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": data})
+}
+
+func TestEncryptedMultipart(t *testing.T) {
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/public", Policy{Request: EncryptionOptional, Response: EncryptionRequired})
+	m := newTestMiddleware(t, nil, WithPolicies(policies))
+	r := newTestRouter(m, echoForm)
+	key := m.keyring.Primary()
+	csv := []byte("id,email\n1,jane@example.com\n")
+
+	for _, tc := range []struct {
+		name     string
+		target   string
+		parts    []formPart
+		status   int
+		file     string
+		fileType string
+	}{
+		{
+			name:     "encrypted field and plaintext file",
+			parts:    []formPart{{name: "name", content: []byte(mustSeal(t, key, "Jane"))}, {name: "file", filename: "a.csv", contentType: "text/csv", content: csv}},
+			status:   http.StatusOK,
+			file:     string(csv),
+			fileType: "text/csv",
+		},
+		{
+			name: "encrypted file",
+			parts: []formPart{
+				{name: "name", content: []byte(mustSeal(t, key, "Jane"))},
+				{name: "file", filename: "a.csv", contentType: mime.FormatMediaType(StreamContentType, map[string]string{"type": "text/csv"}), content: sealStream(t, key, 8, csv)},
+			},
+			status:   http.StatusOK,
+			file:     string(csv),
+			fileType: "text/csv",
+		},
+		{
+			name:   "plaintext field",
+			parts:  []formPart{{name: "name", content: []byte("Jane")}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "plaintext file only",
+			parts:  []formPart{{name: "file", filename: "a.csv", contentType: "text/csv", content: csv}},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "plaintext form on an optional route",
+			target: "/api/v1/public",
+			parts:  []formPart{{name: "name", content: []byte("Jane")}, {name: "file", filename: "a.csv", contentType: "text/csv", content: csv}},
+			status: http.StatusOK,
+			file:   string(csv), fileType: "text/csv",
+		},
+		{
+			name: "tampered file",
+			parts: []formPart{
+				{name: "name", content: []byte(mustSeal(t, key, "Jane"))},
+				{name: "file", filename: "a.csv", contentType: StreamContentType, content: sealStream(t, key, 8, csv)[:60]},
+			},
+			status: http.StatusBadRequest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.target
+			if target == "" {
+				target = "/api/v1/upload"
+			}
+			contentType, body := multipartBody(t, tc.parts...)
+			w := serve(r, http.MethodPost, target, contentType, body, nil)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			data := responseData(t, w).(map[string]interface{})
+			if got := mustOpen(t, m.keyring, data["name"]); got != "Jane" {
+				t.Errorf("handler name = %v, want Jane", got)
+			}
+			if got := mustOpen(t, m.keyring, data["file"]); got != tc.file {
+				t.Errorf("handler file = %q, want %q", got, tc.file)
+			}
+			if got := mustOpen(t, m.keyring, data["fileType"]); got != tc.fileType {
+				t.Errorf("handler file type = %q, want %q", got, tc.fileType)
+			}
+		})
+	}
+}
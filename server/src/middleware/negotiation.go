@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PayloadEncryptionHeader is how a client tells the server which scheme its
+// payload uses. The response is encrypted in the same scheme and carries the
+// header back.
+const PayloadEncryptionHeader = "X-Payload-Encryption"
+
+// PayloadVersion is an encryption scheme a client can negotiate.
+type PayloadVersion string
+
+const (
+	// PayloadNone is plaintext, only accepted on routes where encryption is optional.
+	PayloadNone PayloadVersion = "none"
+	// PayloadV1 is the legacy per-field AES-CBC format.
+	PayloadV1 PayloadVersion = "v1"
+	// PayloadV2 covers the AEAD formats: "v2:" field envelopes in any Suite,
+	// whole-body envelopes, streams and JWE.
+	PayloadV2 PayloadVersion = "v2"
+)
+
+// payloadVersionKey and payloadCipherKey are the gin context keys holding
+// the negotiated version and suite.
+const (
+	payloadVersionKey = "cryptoPayloadVersion"
+	payloadCipherKey  = "cryptoPayloadCipher"
+)
+
+func ParsePayloadVersion(s string) (PayloadVersion, error) {
+	switch v := PayloadVersion(strings.ToLower(strings.TrimSpace(s))); v {
+	case PayloadNone, PayloadV1, PayloadV2:
+		return v, nil
+	default:
+		return "", fmt.Errorf("unknown payload encryption version %q", s)
+	}
+}
+
+func (v PayloadVersion) rank() int {
+	switch v {
+	case PayloadV1:
+		return 1
+	case PayloadV2:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func versionForMode(mode Mode) PayloadVersion {
+	if mode == ModeGCM {
+		return PayloadV2
+	}
+	return PayloadV1
+}
+
+// negotiate works out the payload version of the request and checks it
+// against the route policy and the minimum version. Without
+// PayloadEncryptionHeader the version follows from the request: envelope,
+// stream, JWE and HPKE bodies are v2, as is a request naming a suite in
+// PayloadCipherHeader; anything else uses the configured mode, and field
+// values may still be in either format. It returns the HTTP status to reject
+// the request with.
+func (m *CryptoMiddleware) negotiate(c *gin.Context, policy Policy) (PayloadVersion, int, error) {
+	header := c.GetHeader(PayloadEncryptionHeader)
+	isStream, _ := streamContentType(c.ContentType())
+	envelopeBody := isEncryptedRequest(c) || isStream
+
+	cipher := c.GetHeader(PayloadCipherHeader)
+	version := versionForMode(m.mode)
+	if envelopeBody || cipher != "" {
+		version = PayloadV2
+	}
+	if header != "" {
+		var err error
+		if version, err = ParsePayloadVersion(header); err != nil {
+			return "", http.StatusBadRequest, err
+		}
+	}
+
+	if version.rank() < m.minVersion.rank() {
+		return "", http.StatusUpgradeRequired,
+			fmt.Errorf("payload encryption %s is no longer supported, use %s or later", version, m.minVersion)
+	}
+	switch version {
+	case PayloadNone:
+		if policy.Request == EncryptionRequired || policy.Response == EncryptionRequired || envelopeBody {
+			return "", http.StatusBadRequest, fmt.Errorf("%s requires encryption", c.Request.URL.Path)
+		}
+	case PayloadV1:
+		if envelopeBody || policy.Body == BodyWhole {
+			return "", http.StatusBadRequest, fmt.Errorf("payload encryption v1 only supports per-field bodies")
+		}
+		if c.GetHeader(SessionHeader) != "" {
+			return "", http.StatusBadRequest, fmt.Errorf("session keys require payload encryption v2")
+		}
+	}
+
+	if cipher != "" {
+		if version != PayloadV2 {
+			return "", http.StatusBadRequest, fmt.Errorf("%s requires payload encryption v2", PayloadCipherHeader)
+		}
+		suite, err := ParseSuite(cipher)
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		c.Set(payloadCipherKey, suite)
+	}
+	return version, 0, nil
+}
+
+// withVersion returns a copy of the middleware that only reads and writes
+// the negotiated scheme, instead of accepting both field formats.
+func (m *CryptoMiddleware) withVersion(version PayloadVersion) *CryptoMiddleware {
+	scoped := *m
+	scoped.strict = true
+	if version == PayloadV1 {
+		scoped.mode = ModeCBC
+	} else {
+		scoped.mode = ModeGCM
+	}
+	return &scoped
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParsePayloadVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want PayloadVersion
+		ok   bool
+	}{
+		{"v1", PayloadV1, true},
+		{" V2 ", PayloadV2, true},
+		{"none", PayloadNone, true},
+		{"v3", "", false},
+		{"", "", false},
+	} {
+		got, err := ParsePayloadVersion(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParsePayloadVersion(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestPayloadNegotiation(t *testing.T) {
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/public", Policy{Request: EncryptionOptional, Response: EncryptionOptional})
+	m := newTestMiddleware(t, nil, WithPolicies(policies))
+	r := newTestRouter(m, echoJSON)
+	key := m.keyring.Primary()
+	cbc, err := m.encryptCBC([]byte("jane@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Body := `{"email":"` + mustSeal(t, key, "jane@example.com") + `"}`
+	v1Body := `{"email":"` + cbc + `"}`
+
+	for _, tc := range []struct {
+		name    string
+		target  string
+		version string
+		body    string
+		status  int
+		want    PayloadVersion // of the response
+	}{
+		{name: "v2 named", version: "v2", body: v2Body, status: http.StatusOK, want: PayloadV2},
+		{name: "v1 named", version: "v1", body: v1Body, status: http.StatusOK, want: PayloadV1},
+		{name: "unnamed takes either format", body: v1Body, status: http.StatusOK, want: PayloadV2},
+		{name: "v1 value under v2", version: "v2", body: v1Body, status: http.StatusBadRequest},
+		{name: "v2 value under v1", version: "v1", body: v2Body, status: http.StatusBadRequest},
+		{name: "unknown version", version: "v9", body: v2Body, status: http.StatusBadRequest},
+		{name: "none on a required route", version: "none", body: `{"email":"jane@example.com"}`, status: http.StatusBadRequest},
+		{name: "none on an optional route", target: "/api/v1/public", version: "none", body: `{"email":"jane@example.com"}`, status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.target
+			if target == "" {
+				target = "/api/v1/users"
+			}
+			header := http.Header{}
+			if tc.version != "" {
+				header.Set(PayloadEncryptionHeader, tc.version)
+			}
+			w := serve(r, http.MethodPost, target, "application/json", tc.body, header)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get(PayloadEncryptionHeader); got != string(tc.want) {
+				t.Errorf("response %s = %q, want %q", PayloadEncryptionHeader, got, tc.want)
+			}
+
+			email := responseData(t, w).(map[string]interface{})["email"]
+			switch tc.want {
+			case PayloadV2:
+				if got := mustOpen(t, m.keyring, email); got != "jane@example.com" {
+					t.Errorf("email = %v", got)
+				}
+			case PayloadV1:
+				plaintext, err := m.decryptCBC(email.(string))
+				if err != nil || string(plaintext) != "jane@example.com" {
+					t.Errorf("email = %q, %v, want CBC of jane@example.com", plaintext, err)
+				}
+			default:
+				if email != "jane@example.com" {
+					t.Errorf("email = %v, want it in plaintext", email)
+				}
+			}
+		})
+	}
+}
+
+func TestMinPayloadVersion(t *testing.T) {
+	m := newTestMiddleware(t, nil, WithMinPayloadVersion(PayloadV2))
+	r := newTestRouter(m, echoJSON)
+	cbc, err := m.encryptCBC([]byte("jane@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{PayloadEncryptionHeader: {"v1"}}
+	w := serve(r, http.MethodPost, "/api/v1/users", "application/json", `{"email":"`+cbc+`"}`, header)
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("v1 below the minimum: status = %d, want %d", w.Code, http.StatusUpgradeRequired)
+	}
+
+	body := `{"email":"` + mustSeal(t, m.keyring.Primary(), "jane@example.com") + `"}`
+	if w := serve(r, http.MethodPost, "/api/v1/users", "application/json", body, nil); w.Code != http.StatusOK {
+		t.Errorf("v2 status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestV1RejectsV2Features(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, echoJSON)
+	cbc, err := m.encryptCBC([]byte("jane@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"email":"` + cbc + `"}`
+	handshake, _ := clientHandshake(t, m)
+
+	for name, header := range map[string]http.Header{
+		"cipher":  {PayloadEncryptionHeader: {"v1"}, PayloadCipherHeader: {string(SuiteChaCha20)}},
+		"session": {PayloadEncryptionHeader: {"v1"}, SessionHeader: {handshake.SessionID}},
+	} {
+		if w := serve(r, http.MethodPost, "/api/v1/users", "application/json", body, header); w.Code != http.StatusBadRequest {
+			t.Errorf("v1 with a %s header: status = %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
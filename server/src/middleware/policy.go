@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Software78/encryption-test/src/jsoncrypt"
+)
+
+// Requirement says whether a request or response on a route must be encrypted.
+type Requirement string
+
+const (
+	// EncryptionRequired rejects plaintext requests and always encrypts responses.
+	EncryptionRequired Requirement = "required"
+	// EncryptionOptional accepts plaintext requests and only encrypts the
+	// response when the request was encrypted.
+	EncryptionOptional Requirement = "optional"
+	// EncryptionDisabled leaves the route alone and rejects encrypted requests.
+	EncryptionDisabled Requirement = "disabled"
+)
+
+// Policy is the encryption policy of a route group.
+type Policy struct {
+	Request  Requirement
+	Response Requirement
+	// Body forces a body mode for the route. When empty, the client picks it
+	// with Content-Type and Accept.
+	Body BodyMode
+	// Signed requires requests to be signed, see VerifySignatureMiddleware.
+	Signed bool
+	// Fields limits per-field response encryption to the selected values,
+	// e.g. jsoncrypt.MustTagRules("$.data", models.User{}). When empty every
+	// value is encrypted. Whole-body responses are always fully encrypted.
+	Fields jsoncrypt.Rules
+}
+
+var (
+	// PolicyRequired encrypts requests and responses, letting the client pick the body mode.
+	PolicyRequired = Policy{Request: EncryptionRequired, Response: EncryptionRequired}
+	// PolicyDisabled turns the crypto middleware off, e.g. for docs and the handshake.
+	PolicyDisabled = Policy{Request: EncryptionDisabled, Response: EncryptionDisabled}
+)
+
+func (p Policy) String() string {
+	body := p.Body
+	if body == "" {
+		body = "negotiated"
+	}
+	fields := "all"
+	if len(p.Fields) > 0 {
+		fields = p.Fields.String()
+	}
+	return fmt.Sprintf("request=%s response=%s body=%s signed=%t fields=%s", p.Request, p.Response, body, p.Signed, fields)
+}
+
+func (p Policy) validate() error {
+	for _, r := range []Requirement{p.Request, p.Response} {
+		switch r {
+		case EncryptionRequired, EncryptionOptional, EncryptionDisabled:
+		default:
+			return fmt.Errorf("unknown encryption requirement %q", r)
+		}
+	}
+	switch p.Body {
+	case "", BodyFields, BodyWhole:
+	default:
+		return fmt.Errorf("unknown body mode %q", p.Body)
+	}
+	return nil
+}
+
+// RoutePolicy is a policy registered for a path prefix.
+type RoutePolicy struct {
+	Prefix string
+	Policy Policy
+}
+
+// PolicyRegistry maps route groups to their encryption policy. The policy of
+// the longest registered prefix matching a path wins; paths matching no
+// prefix get the default policy.
+type PolicyRegistry struct {
+	mu       sync.RWMutex
+	fallback Policy
+	routes   []RoutePolicy
+}
+
+func NewPolicyRegistry(fallback Policy) *PolicyRegistry {
+	return &PolicyRegistry{fallback: fallback}
+}
+
+// Register sets the policy for every path under prefix, e.g. "/api/v1/auth".
+// Like gin's route registration it panics on an invalid policy, since that
+// is a programming error caught at startup.
+func (r *PolicyRegistry) Register(prefix string, policy Policy) {
+	if err := policy.validate(); err != nil {
+		panic(fmt.Sprintf("invalid encryption policy for %s: %v", prefix, err))
+	}
+	prefix = "/" + strings.Trim(prefix, "/")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, route := range r.routes {
+		if route.Prefix == prefix {
+			r.routes[i].Policy = policy
+			return
+		}
+	}
+	r.routes = append(r.routes, RoutePolicy{Prefix: prefix, Policy: policy})
+	// Longest prefix first so Lookup can stop at the first match
+	sort.SliceStable(r.routes, func(i, j int) bool { return len(r.routes[i].Prefix) > len(r.routes[j].Prefix) })
+}
+
+// Lookup returns the policy for a request path.
+func (r *PolicyRegistry) Lookup(path string) Policy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, route := range r.routes {
+		if matchesPrefix(path, route.Prefix) {
+			return route.Policy
+		}
+	}
+	return r.fallback
+}
+
+// Routes lists the registered policies sorted by prefix, followed by the default under "*".
+func (r *PolicyRegistry) Routes() []RoutePolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	routes := append([]RoutePolicy(nil), r.routes...)
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Prefix < routes[j].Prefix })
+	return append(routes, RoutePolicy{Prefix: "*", Policy: r.fallback})
+}
+
+// matchesPrefix matches whole path segments, so "/api/v1/auth" matches
+// "/api/v1/auth/login" but not "/api/v1/authors".
+func matchesPrefix(path, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
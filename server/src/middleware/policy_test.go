@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/Software78/encryption-test/src/jsoncrypt"
+	"github.com/gin-gonic/gin"
+)
+
+func TestPolicyRegistryLookup(t *testing.T) {
+	optional := Policy{Request: EncryptionOptional, Response: EncryptionOptional}
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/docs", PolicyDisabled)
+	policies.Register("/api/v1/auth/", optional)
+	policies.Register("/api/v1/auth/login", PolicyRequired)
+
+	for _, tc := range []struct {
+		path string
+		want Policy
+	}{
+		{"/api/v1/docs", PolicyDisabled},
+		{"/api/v1/docs/index.html", PolicyDisabled},
+		{"/api/v1/docsx", PolicyRequired},
+		{"/api/v1/auth/register", optional},
+		{"/api/v1/auth/login", PolicyRequired},
+		{"/api/v1/auth/login/extra", PolicyRequired},
+		{"/api/v1/users", PolicyRequired},
+	} {
+		if got := policies.Lookup(tc.path); got.String() != tc.want.String() {
+			t.Errorf("Lookup(%q) = %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyRegistryRejectsInvalidPolicy(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Register accepted an unknown requirement")
+		}
+	}()
+	NewPolicyRegistry(PolicyRequired).Register("/api", Policy{Request: "sometimes", Response: EncryptionRequired})
+}
+
+func TestPolicyRoundTrips(t *testing.T) {
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/optional", Policy{Request: EncryptionOptional, Response: EncryptionOptional})
+	policies.Register("/disabled", PolicyDisabled)
+	m := newTestMiddleware(t, nil, WithPolicies(policies))
+	r := newTestRouter(m, echoJSON)
+
+	plain := `{"name":"Jane"}`
+	encrypted := `{"name":"` + mustSeal(t, m.keyring.Primary(), "Jane") + `"}`
+	sealed, err := m.sealBody([]byte(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		status      int
+		encrypted   bool // whether the response name is encrypted
+	}{
+		{"required plaintext", "/required", "application/json", plain, http.StatusBadRequest, false},
+		{"required fields", "/required", "application/json", encrypted, http.StatusOK, true},
+		{"optional plaintext", "/optional", "application/json", plain, http.StatusOK, false},
+		{"optional fields", "/optional", "application/json", encrypted, http.StatusOK, true},
+		{"disabled plaintext", "/disabled", "application/json", plain, http.StatusOK, false},
+		{"disabled whole body", "/disabled", EncryptedContentType, string(sealed), http.StatusUnsupportedMediaType, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(r, http.MethodPost, tc.path, tc.contentType, tc.body, nil)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			name := responseData(t, w).(map[string]interface{})["name"]
+			if tc.encrypted {
+				name = mustOpen(t, m.keyring, name)
+			}
+			if name != "Jane" {
+				t.Errorf("name = %v, want Jane", name)
+			}
+		})
+	}
+}
+
+type policyUser struct {
+	Name    string `json:"name"`
+	Email   string `json:"email" crypt:"encrypt"`
+	Address struct {
+		City   string `json:"city"`
+		Street string `json:"street" crypt:"encrypt"`
+	} `json:"address"`
+}
+
+func TestFieldsPolicy(t *testing.T) {
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/users", Policy{
+		Request:  EncryptionRequired,
+		Response: EncryptionRequired,
+		Fields:   jsoncrypt.MustTagRules("$.data", policyUser{}),
+	})
+	m := newTestMiddleware(t, nil, WithPolicies(policies))
+	r := newTestRouter(m, func(c *gin.Context) {
+		var user policyUser
+		user.Name, user.Email = "Jane", "jane@example.com"
+		user.Address.City, user.Address.Street = "Lagos", "1 Main St"
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": user})
+	})
+
+	var emails []string
+	for i := 0; i < 2; i++ {
+		w := serve(r, http.MethodGet, "/api/v1/users/1", "", "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		data := responseData(t, w).(map[string]interface{})
+		address := data["address"].(map[string]interface{})
+		if data["name"] != "Jane" || address["city"] != "Lagos" {
+			t.Errorf("untagged fields must stay readable: %s", w.Body)
+		}
+		if got := mustOpen(t, m.keyring, address["street"]); got != "1 Main St" {
+			t.Errorf("street = %v", got)
+		}
+
+		if got := mustOpen(t, m.keyring, data["email"]); got != "jane@example.com" {
+			t.Errorf("email = %v", got)
+		}
+		emails = append(emails, data["email"].(string))
+	}
+	// Transport encryption is never deterministic, so equal values don't show
+	if emails[0] == emails[1] {
+		t.Errorf("email has the same envelope in both responses: %q", emails[0])
+	}
+}
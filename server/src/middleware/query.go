@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EncryptedQueryParam carries a whole query string sealed as one v2 envelope,
+// which also hides the parameter names:
+//
+//	?_enc=v2:<kid>:<base64(nonce || AES-GCM("email=a%40b.c&page=2"))>
+//
+// Individual parameters can instead carry a v2 field envelope as their value.
+// Legacy CBC values are not accepted in queries, since they can't be told
+// apart from plaintext.
+const EncryptedQueryParam = "_enc"
+
+// decryptQuery replaces encrypted query parameters with their plaintext, so
+// c.Query and ShouldBindQuery never see ciphertext. It reports whether the
+// query held anything encrypted.
+func (m *CryptoMiddleware) decryptQuery(c *gin.Context) (bool, error) {
+	query := c.Request.URL.Query()
+	decrypted := url.Values{}
+	encrypted := false
+
+	for name, values := range query {
+		if name == EncryptedQueryParam {
+			for _, value := range values {
+				plaintext, err := openEnvelope(m.keyring, value)
+				if err != nil {
+					return false, fmt.Errorf("%s: %w", EncryptedQueryParam, err)
+				}
+				inner, err := url.ParseQuery(string(plaintext))
+				if err != nil {
+					return false, fmt.Errorf("%s: %w", EncryptedQueryParam, err)
+				}
+				for innerName, innerValues := range inner {
+					decrypted[innerName] = append(decrypted[innerName], innerValues...)
+				}
+			}
+			encrypted = true
+			continue
+		}
+
+		for _, value := range values {
+			if isEnvelope(value) {
+				plain, err := m.decryptScalar(value)
+				if err != nil {
+					return false, fmt.Errorf("parameter %s: %w", name, err)
+				}
+				value = plain
+				encrypted = true
+			}
+			decrypted.Add(name, value)
+		}
+	}
+
+	if encrypted {
+		c.Request.URL.RawQuery = decrypted.Encode()
+	}
+	return encrypted, nil
+}
+
+// decryptHeaders decrypts the allow-listed headers in place. Their values may
+// be in either field format. On routes where request encryption is optional a
+// header that doesn't decrypt is left as it is.
+func (m *CryptoMiddleware) decryptHeaders(c *gin.Context, policy Policy) (bool, error) {
+	encrypted := false
+	for _, name := range m.encryptedHeaders {
+		values := c.Request.Header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+
+		plain := make([]string, 0, len(values))
+		for _, value := range values {
+			decrypted, err := m.decryptScalar(value)
+			if err != nil {
+				if policy.Request == EncryptionOptional {
+					decrypted = value
+				} else {
+					return false, fmt.Errorf("header %s: %w", name, err)
+				}
+			} else {
+				encrypted = true
+			}
+			if strings.ContainsAny(decrypted, "\r\n") {
+				return false, fmt.Errorf("header %s: decrypted value contains a line break", name)
+			}
+			plain = append(plain, decrypted)
+		}
+		c.Request.Header[http.CanonicalHeaderKey(name)] = plain
+	}
+	return encrypted, nil
+}
+
+// decryptScalar decrypts a value that has to end up as a string, like a query
+// parameter or a header. Objects and arrays are rejected.
+func (m *CryptoMiddleware) decryptScalar(value string) (string, error) {
+	decrypted, err := m.decryptLeaf(value)
+	if err != nil {
+		return "", err
+	}
+	switch v := decrypted.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("expected a string, number or boolean, got %T", v)
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// echoQuery responds with the query and the X-Customer-ID header the handler sees.
+func echoQuery(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "success": true, "data": gin.H{
+		"query":    c.Request.URL.Query(),
+		"customer": c.GetHeader("X-Customer-ID"),
+	}})
+}
+
+func queryResponse(t *testing.T, m *CryptoMiddleware, r http.Handler, target string, header http.Header) (url.Values, string, int) {
+	t.Helper()
+	w := serve(r, http.MethodGet, target, "", "", header)
+	if w.Code != http.StatusOK {
+		return nil, "", w.Code
+	}
+	data := responseData(t, w).(map[string]interface{})
+	query := url.Values{}
+	for name, values := range data["query"].(map[string]interface{}) {
+		for _, value := range values.([]interface{}) {
+			query.Add(name, mustOpen(t, m.keyring, value).(string))
+		}
+	}
+	customer, _ := mustOpen(t, m.keyring, data["customer"]).(string)
+	return query, customer, w.Code
+}
+
+func TestEncryptedQuery(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, echoQuery)
+	key := m.keyring.Primary()
+
+	sealedQuery, err := sealGCM(key, []byte("email=jane%40example.com&page=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		query url.Values
+		want  url.Values
+	}{
+		{
+			name:  "whole query",
+			query: url.Values{EncryptedQueryParam: {sealedQuery}, "sort": {"name"}},
+			want:  url.Values{"email": {"jane@example.com"}, "page": {"2"}, "sort": {"name"}},
+		},
+		{
+			name:  "single values",
+			query: url.Values{"email": {mustSeal(t, key, "jane@example.com")}, "page": {mustSeal(t, key, 2)}},
+			want:  url.Values{"email": {"jane@example.com"}, "page": {"2"}},
+		},
+		{
+			name:  "plaintext",
+			query: url.Values{"page": {"2"}},
+			want:  url.Values{"page": {"2"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query, _, status := queryResponse(t, m, r, "/api/v1/users?"+tc.query.Encode(), nil)
+			if status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if query.Encode() != tc.want.Encode() {
+				t.Errorf("handler query = %v, want %v", query, tc.want)
+			}
+		})
+	}
+
+	for name, query := range map[string]url.Values{
+		"bad whole query": {EncryptedQueryParam: {"v2:transport-1:AAAA"}},
+		"unknown key":     {"email": {mustSeal(t, randomKey(t, "transport-9", KeyPrimary), "jane@example.com")}},
+		"object value":    {"filter": {mustSeal(t, key, map[string]interface{}{"a": 1})}},
+	} {
+		if _, _, status := queryResponse(t, m, r, "/api/v1/users?"+query.Encode(), nil); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", name, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestEncryptedHeaders(t *testing.T) {
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/public", Policy{Request: EncryptionOptional, Response: EncryptionRequired})
+	m := newTestMiddleware(t, nil, WithPolicies(policies), WithEncryptedHeaders("X-Customer-ID"))
+	r := newTestRouter(m, echoQuery)
+	key := m.keyring.Primary()
+
+	header := http.Header{"X-Customer-Id": {mustSeal(t, key, "cus_123")}}
+	if _, customer, status := queryResponse(t, m, r, "/api/v1/users", header); status != http.StatusOK || customer != "cus_123" {
+		t.Errorf("encrypted header: %d, handler saw %q, want cus_123", status, customer)
+	}
+
+	plain := http.Header{"X-Customer-Id": {"cus_123"}}
+	if _, _, status := queryResponse(t, m, r, "/api/v1/users", plain); status != http.StatusBadRequest {
+		t.Errorf("plaintext header on a required route: status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if _, customer, status := queryResponse(t, m, r, "/api/v1/public", plain); status != http.StatusOK || customer != "cus_123" {
+		t.Errorf("plaintext header on an optional route: %d, handler saw %q, want cus_123", status, customer)
+	}
+
+	injected := http.Header{"X-Customer-Id": {mustSeal(t, key, "cus_123\r\nX-Admin: true")}}
+	if _, _, status := queryResponse(t, m, r, "/api/v1/users", injected); status != http.StatusBadRequest {
+		t.Errorf("header with a line break: status = %d, want %d", status, http.StatusBadRequest)
+	}
+}
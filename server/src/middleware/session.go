@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"container/heap"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// SessionHeader carries the session ID returned by the handshake. Requests
+// that send it are decrypted, and their responses encrypted, with the
+// session key instead of the shared keyring.
+const SessionHeader = "X-Session-ID"
+
+const (
+	DefaultSessionTTL      = 24 * time.Hour
+	DefaultSessionCapacity = 100_000
+)
+
+// handshakeInfo is the HKDF info prefix; both public keys are appended so the
+// derived key is bound to this exchange.
+const handshakeInfo = "encryption-test handshake v1"
+
+var (
+	ErrSessionNotFound  = errors.New("session not found or expired")
+	ErrSessionStoreFull = errors.New("session store is full")
+	ErrInvalidPeerKey   = errors.New("invalid client public key")
+)
+
+// Session is a key agreed with a single client, or issued to a user on login.
+type Session struct {
+	ID        string
+	Key       []byte
+	ExpiresAt time.Time
+	UserID    string // set for login sessions, see IssueSessionKey
+}
+
+// SessionStore keeps session keys between the handshake and later requests.
+type SessionStore interface {
+	Put(session *Session) error
+	Get(id string) (*Session, error)
+	Delete(id string) error
+}
+
+// MemorySessionStore is a SessionStore for a single instance holding at
+// most capacity sessions. Expired sessions are dropped as new ones arrive and
+// when they are looked up; when the store is still full it refuses new
+// sessions with ErrSessionStoreFull, since the handshake lets anyone add one.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	capacity int
+	sessions map[string]*Session
+	expiries sessionHeap // soonest expiry first, used to find expired sessions
+}
+
+func NewMemorySessionStore(capacity int) *MemorySessionStore {
+	return &MemorySessionStore{capacity: capacity, sessions: make(map[string]*Session)}
+}
+
+func (s *MemorySessionStore) Put(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+	if _, ok := s.sessions[session.ID]; !ok && len(s.sessions) >= s.capacity {
+		return ErrSessionStoreFull
+	}
+	s.sessions[session.ID] = session
+	heap.Push(&s.expiries, sessionExpiry{id: session.ID, expiresAt: session.ExpiresAt})
+	return nil
+}
+
+// purge drops every expired session. Login sessions may outlive handshake
+// sessions, so the heap keeps them in expiry order rather than arrival order.
+func (s *MemorySessionStore) purge(now time.Time) {
+	for len(s.expiries) > 0 && now.After(s.expiries[0].expiresAt) {
+		expired := heap.Pop(&s.expiries).(sessionExpiry)
+		if session, ok := s.sessions[expired.id]; ok && session.ExpiresAt.Equal(expired.expiresAt) {
+			delete(s.sessions, expired.id)
+		}
+	}
+}
+
+func (s *MemorySessionStore) Get(id string) (*Session, error) {
+	s.mu.RLock()
+	session, ok := s.sessions[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if time.Now().After(session.ExpiresAt) {
+		s.Delete(id)
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+type sessionExpiry struct {
+	id        string
+	expiresAt time.Time
+}
+
+// sessionHeap is a container/heap min-heap of sessions by expiry.
+type sessionHeap []sessionExpiry
+
+func (h sessionHeap) Len() int            { return len(h) }
+func (h sessionHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h sessionHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sessionHeap) Push(x interface{}) { *h = append(*h, x.(sessionExpiry)) }
+func (h *sessionHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// HandshakeResult is what the client needs to derive the same session key.
+type HandshakeResult struct {
+	SessionID       string
+	ServerPublicKey []byte
+	Salt            []byte
+	ExpiresAt       time.Time
+}
+
+// Handshake runs X25519 key agreement with the client's public key and
+// derives a session key with HKDF-SHA256:
+//
+//	key = HKDF(secret = X25519(server, client), salt, info = handshakeInfo || clientPub || serverPub)
+//
+// The session is stored and can be used by sending SessionHeader.
+func (m *CryptoMiddleware) Handshake(clientPublicKey []byte) (*HandshakeResult, error) {
+	curve := ecdh.X25519()
+	peer, err := curve.NewPublicKey(clientPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPeerKey, err)
+	}
+	private, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPeerKey, err)
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	serverPublicKey := private.PublicKey().Bytes()
+	info := append([]byte(handshakeInfo), clientPublicKey...)
+	info = append(info, serverPublicKey...)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), key); err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:        uuid.NewString(),
+		Key:       key,
+		ExpiresAt: time.Now().Add(m.sessionTTL),
+	}
+	if err := m.sessions.Put(session); err != nil {
+		return nil, err
+	}
+
+	return &HandshakeResult{
+		SessionID:       session.ID,
+		ServerPublicKey: serverPublicKey,
+		Salt:            salt,
+		ExpiresAt:       session.ExpiresAt,
+	}, nil
+}
+
+// forSession returns a copy of the middleware that encrypts and decrypts
+// with the session key. Sessions always use v2 envelopes keyed by the session ID.
+func (m *CryptoMiddleware) forSession(session *Session) (*CryptoMiddleware, error) {
+	keyring, err := NewKeyring(Key{ID: session.ID, Material: session.Key, Status: KeyPrimary})
+	if err != nil {
+		return nil, err
+	}
+	scoped := *m
+	scoped.keyring = keyring
+	scoped.mode = ModeGCM
+	return &scoped, nil
+}
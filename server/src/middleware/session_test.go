@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// clientHandshake runs the client side of Handshake and returns the session
+// key the client derives.
+func clientHandshake(t *testing.T, m *CryptoMiddleware) (*HandshakeResult, Key) {
+	t.Helper()
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := m.Handshake(private.PublicKey().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ecdh.X25519().NewPublicKey(result.ServerPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := private.ECDH(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := append([]byte(handshakeInfo), private.PublicKey().Bytes()...)
+	info = append(info, result.ServerPublicKey...)
+	material := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, result.Salt, info), material); err != nil {
+		t.Fatal(err)
+	}
+	return result, Key{ID: result.SessionID, Material: material, Status: KeyPrimary}
+}
+
+func TestHandshakeSessionRoundTrip(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	result, key := clientHandshake(t, m)
+	session, err := NewKeyring(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRouter(m, echoJSON)
+	body := `{"name":"` + mustSeal(t, key, "Jane") + `"}`
+	w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", body, http.Header{SessionHeader: {result.SessionID}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	data := responseData(t, w).(map[string]interface{})
+	if got := mustOpen(t, session, data["name"]); got != "Jane" {
+		t.Errorf("name = %v, want Jane", got)
+	}
+
+	// The shared transport key is not accepted on a session
+	body = `{"name":"` + mustSeal(t, m.keyring.Primary(), "Jane") + `"}`
+	w = serve(r, http.MethodPost, "/api/v1/echo", "application/json", body, http.Header{SessionHeader: {result.SessionID}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("transport key on a session: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandshakeRejects(t *testing.T) {
+	m := newTestMiddleware(t, nil, WithSessionStore(NewMemorySessionStore(DefaultSessionCapacity), time.Millisecond))
+	if _, err := m.Handshake([]byte("not a key")); !errors.Is(err, ErrInvalidPeerKey) {
+		t.Errorf("Handshake with a bad key = %v, want ErrInvalidPeerKey", err)
+	}
+	// The all-zero point gives an all-zero shared secret
+	if _, err := m.Handshake(make([]byte, 32)); !errors.Is(err, ErrInvalidPeerKey) {
+		t.Errorf("Handshake with a low-order point = %v, want ErrInvalidPeerKey", err)
+	}
+
+	result, key := clientHandshake(t, m)
+	time.Sleep(5 * time.Millisecond)
+	r := newTestRouter(m, echoJSON)
+	body := `{"name":"` + mustSeal(t, key, "Jane") + `"}`
+	w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", body, http.Header{SessionHeader: {result.SessionID}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expired session: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemorySessionStore(3)
+	put := func(id string, expiresAt time.Time) error {
+		return store.Put(&Session{ID: id, Key: make([]byte, 32), ExpiresAt: expiresAt})
+	}
+
+	// Expiries out of arrival order: b arrived after a but expires first
+	for _, session := range []struct {
+		id        string
+		expiresAt time.Time
+	}{{"a", now.Add(time.Hour)}, {"b", now.Add(50 * time.Millisecond)}, {"c", now.Add(time.Hour)}} {
+		if err := put(session.id, session.expiresAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := put("d", now.Add(time.Hour)); !errors.Is(err, ErrSessionStoreFull) {
+		t.Errorf("Put on a full store = %v, want ErrSessionStoreFull", err)
+	}
+	// Replacing a stored session needs no room
+	if err := put("a", now.Add(2*time.Hour)); err != nil {
+		t.Errorf("Put of a stored session on a full store = %v", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	// b has expired, so there is room for d without dropping a or c
+	if err := put("d", now.Add(time.Hour)); err != nil {
+		t.Errorf("Put with an expired session to purge = %v", err)
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, err := store.Get(id); err != nil {
+			t.Errorf("Get(%s) after the purge = %v", id, err)
+		}
+	}
+	if _, err := store.Get("b"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Get(b) = %v, want ErrSessionNotFound", err)
+	}
+	// The replacement of a is what is stored
+	if session, err := store.Get("a"); err != nil || !session.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("Get(a) = %v, %v, want the replacement", session, err)
+	}
+
+	m := newTestMiddleware(t, nil, WithSessionStore(NewMemorySessionStore(1), time.Hour))
+	clientHandshake(t, m)
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Handshake(private.PublicKey().Bytes()); !errors.Is(err, ErrSessionStoreFull) {
+		t.Errorf("Handshake on a full store = %v, want ErrSessionStoreFull", err)
+	}
+}
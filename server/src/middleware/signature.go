@@ -0,0 +1,337 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Signed requests carry these headers. SignatureHeader is "<kid>:<base64 HMAC>".
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+const (
+	// DefaultSignatureWindow is how far a request timestamp may be from the server clock.
+	DefaultSignatureWindow = 5 * time.Minute
+	DefaultNonceCapacity   = 100_000
+
+	signingInfo = "encryption-test request signing v1"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrNonceReused      = errors.New("nonce has already been used")
+	ErrNonceStoreFull   = errors.New("nonce store is full")
+)
+
+// NonceStore remembers the nonces of signed requests until their timestamp
+// leaves the signature window. Use a shared implementation (e.g. Redis SET NX
+// with an expiry) when running more than one instance.
+type NonceStore interface {
+	// Remember records nonce until expiresAt. It returns ErrNonceReused if
+	// the nonce is already recorded.
+	Remember(nonce string, expiresAt time.Time) error
+}
+
+// MemoryNonceStore is a NonceStore for a single instance holding at most
+// capacity nonces. Expired nonces are dropped as new ones arrive; when the
+// store is still full it refuses new nonces rather than forgetting live ones,
+// which would reopen them to replay.
+type MemoryNonceStore struct {
+	mu       sync.Mutex
+	capacity int
+	nonces   map[string]time.Time
+	expiries nonceHeap // soonest expiry first, used to find expired nonces
+}
+
+func NewMemoryNonceStore(capacity int) *MemoryNonceStore {
+	return &MemoryNonceStore{capacity: capacity, nonces: make(map[string]time.Time)}
+}
+
+func (s *MemoryNonceStore) Remember(nonce string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if expiry, ok := s.nonces[nonce]; ok && now.Before(expiry) {
+		return ErrNonceReused
+	}
+	s.purge(now)
+	if len(s.nonces) >= s.capacity {
+		return ErrNonceStoreFull
+	}
+	s.nonces[nonce] = expiresAt
+	heap.Push(&s.expiries, nonceExpiry{nonce: nonce, expiresAt: expiresAt})
+	return nil
+}
+
+// purge drops every expired nonce. Expiries follow the signed timestamps,
+// which may be up to a window either side of now, so nonces do not expire in
+// the order they arrive; the heap keeps them in expiry order instead.
+func (s *MemoryNonceStore) purge(now time.Time) {
+	for len(s.expiries) > 0 && !now.Before(s.expiries[0].expiresAt) {
+		expired := heap.Pop(&s.expiries).(nonceExpiry)
+		if s.nonces[expired.nonce].Equal(expired.expiresAt) {
+			delete(s.nonces, expired.nonce)
+		}
+	}
+}
+
+type nonceExpiry struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// nonceHeap is a container/heap min-heap of nonces by expiry.
+type nonceHeap []nonceExpiry
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(nonceExpiry)) }
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// canonicalRequest is the string a request signature covers:
+//
+//	METHOD \n request URI \n unix timestamp \n nonce \n base64(SHA-256(body))
+//
+// For StreamContentType bodies the digest is over the stream header. Every
+// segment is authenticated with the header as associated data, and the header
+// holds a random salt, so it pins the whole stream without buffering it.
+func canonicalRequest(method, uri string, timestamp int64, nonce string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(strings.Join([]string{
+		method,
+		uri,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		base64.StdEncoding.EncodeToString(digest[:]),
+	}, "\n"))
+}
+
+// signingKey derives the HMAC key from a keyring key, so the encryption key
+// itself is never used for anything but encryption.
+func signingKey(key Key) ([]byte, error) {
+	derived := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.Material, nil, []byte(signingInfo)), derived); err != nil {
+		return nil, err
+	}
+	return derived, nil
+}
+
+func sign(key Key, canonical []byte) ([]byte, error) {
+	derived, err := signingKey(key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, derived)
+	mac.Write(canonical)
+	return mac.Sum(nil), nil
+}
+
+// SignRequest signs req with key, setting the signature headers. The body is
+// read and replaced, so it must be the final (encrypted) body.
+func SignRequest(req *http.Request, key Key) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if ok, _ := streamContentType(req.Header.Get("Content-Type")); ok {
+		header, err := peekStreamHeader(bufio.NewReader(bytes.NewReader(body)))
+		if err != nil {
+			return err
+		}
+		body = header
+	}
+
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	timestamp := time.Now().Unix()
+
+	signature, err := sign(key, canonicalRequest(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureNonceHeader, nonce)
+	req.Header.Set(SignatureHeader, key.ID+":"+base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// VerifySignatureMiddleware rejects requests to routes whose Policy is Signed
+// unless they carry a valid signature with a fresh timestamp and an unused
+// nonce. It checks the body as sent, so it must run before DecryptRequestMiddleware.
+//
+// HPKE requests with a body are let through unsigned: their clients hold no
+// key to sign with. Their timestamp and nonce are bound into the HPKE AAD
+// instead and checked when DecryptRequestMiddleware opens the body, so an
+// HPKE request without a body is refused here.
+func (m *CryptoMiddleware) VerifySignatureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy := m.policies.Lookup(c.Request.URL.Path)
+		if !policy.Signed {
+			c.Next()
+			return
+		}
+
+		cm, err := m.forRequest(c)
+		if err != nil {
+			c.Error(NewAppError(http.StatusUnauthorized, err.Error(), nil))
+			c.Abort()
+			return
+		}
+
+		if isHPKEContentType(c.ContentType()) {
+			err = cm.checkHPKEBody(c)
+		} else {
+			err = cm.verifySignature(c)
+		}
+		if err != nil {
+			status := http.StatusUnauthorized
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.Is(err, ErrNonceStoreFull):
+				status = http.StatusServiceUnavailable
+			case errors.As(err, &tooLarge):
+				status = http.StatusRequestEntityTooLarge
+			}
+			c.Error(NewAppError(status, err.Error(), nil))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func (m *CryptoMiddleware) verifySignature(c *gin.Context) error {
+	kid, encoded, ok := strings.Cut(c.GetHeader(SignatureHeader), ":")
+	if !ok {
+		return fmt.Errorf("%w: missing or malformed %s", ErrInvalidSignature, SignatureHeader)
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	timestamp, nonce, err := m.requestFreshness(c)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	key, err := m.keyring.Lookup(kid)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	body, err := m.signedBody(c)
+	if err != nil {
+		return err
+	}
+	expected, err := sign(key, canonicalRequest(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce, body))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidSignature
+	}
+
+	// Only remember nonces of valid signatures, so forged requests can't fill the store
+	return m.nonces.Remember(kid+":"+nonce, time.Unix(timestamp, 0).Add(m.signatureWindow))
+}
+
+// checkHPKEBody makes sure an unsigned HPKE request has a body for
+// DecryptRequestMiddleware to open, since only opening it checks the
+// timestamp and nonce.
+func (m *CryptoMiddleware) checkHPKEBody(c *gin.Context) error {
+	body, err := m.signedBody(c)
+	if err != nil {
+		return err
+	}
+	if len(body) == 0 {
+		return fmt.Errorf("%w: HPKE request without a body", ErrInvalidSignature)
+	}
+	return nil
+}
+
+// requestFreshness returns the timestamp and nonce headers of a request,
+// checking the timestamp is within the signature window. The caller
+// remembers the nonce once the request is authenticated.
+func (m *CryptoMiddleware) requestFreshness(c *gin.Context) (int64, string, error) {
+	nonce := c.GetHeader(SignatureNonceHeader)
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return 0, "", fmt.Errorf("nonce must be 16 to 128 characters")
+	}
+	timestamp, err := strconv.ParseInt(c.GetHeader(SignatureTimestampHeader), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid %s", SignatureTimestampHeader)
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > m.signatureWindow || skew < -m.signatureWindow {
+		return 0, "", fmt.Errorf("timestamp is outside the %s window", m.signatureWindow)
+	}
+	return timestamp, nonce, nil
+}
+
+// signedBody returns the bytes the body digest covers and leaves the request
+// body readable for the next handler.
+func (m *CryptoMiddleware) signedBody(c *gin.Context) ([]byte, error) {
+	if ok, _ := streamContentType(c.ContentType()); ok {
+		reader := bufio.NewReader(c.Request.Body)
+		header, err := peekStreamHeader(reader)
+		if err != nil {
+			return nil, err
+		}
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{reader, c.Request.Body}
+		return header, nil
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, m.maxBodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// peekStreamHeader returns the raw stream header without consuming it.
+func peekStreamHeader(r *bufio.Reader) ([]byte, error) {
+	fixed, err := r.Peek(2)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidStream, err)
+	}
+	header, err := r.Peek(2 + int(fixed[1]) + 4 + streamSaltSize + streamPrefixSize)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidStream, err)
+	}
+	return append([]byte(nil), header...), nil
+}
@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSignedTestRouter(t *testing.T, opts ...Option) (http.Handler, *CryptoMiddleware) {
+	t.Helper()
+	policies := NewPolicyRegistry(PolicyRequired)
+	policies.Register("/api/v1/signed", Policy{Request: EncryptionRequired, Response: EncryptionRequired, Signed: true})
+	m := newTestMiddleware(t, nil, append([]Option{WithPolicies(policies)}, opts...)...)
+	return newTestRouter(m, echoJSON), m
+}
+
+func signedRequest(t *testing.T, key Key, target, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if err := SignRequest(req, key); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func serveRequest(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestSignedRequest(t *testing.T) {
+	r, m := newSignedTestRouter(t)
+	key := m.keyring.Primary()
+	body := `{"email":"` + mustSeal(t, key, "jane@example.com") + `"}`
+
+	req := signedRequest(t, key, "/api/v1/signed?page=1", body)
+	if w := serveRequest(r, req); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+
+	replay := httptest.NewRequest(http.MethodPost, "/api/v1/signed?page=1", strings.NewReader(body))
+	replay.Header = req.Header.Clone()
+	if w := serveRequest(r, replay); w.Code != http.StatusUnauthorized {
+		t.Errorf("replay status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Unsigned routes do not need a signature
+	if w := serve(r, http.MethodPost, "/api/v1/users", "application/json", body, nil); w.Code != http.StatusOK {
+		t.Errorf("unsigned route status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSignedRequestRejected(t *testing.T) {
+	r, m := newSignedTestRouter(t)
+	key := m.keyring.Primary()
+	body := `{"email":"` + mustSeal(t, key, "jane@example.com") + `"}`
+
+	// signAt signs like SignRequest, at a chosen time
+	signAt := func(req *http.Request, at time.Time) {
+		nonce := "nonce-" + strconv.FormatInt(at.UnixNano(), 10)
+		signature, err := sign(key, canonicalRequest(req.Method, req.URL.RequestURI(), at.Unix(), nonce, []byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(SignatureTimestampHeader, strconv.FormatInt(at.Unix(), 10))
+		req.Header.Set(SignatureNonceHeader, nonce)
+		req.Header.Set(SignatureHeader, key.ID+":"+base64.StdEncoding.EncodeToString(signature))
+	}
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		sign   func(*http.Request)
+	}{
+		{name: "unsigned", sign: func(*http.Request) {}},
+		{name: "body changed", sign: func(req *http.Request) {
+			signed := signedRequest(t, key, "/api/v1/signed", `{"email":"other"}`)
+			req.Header = signed.Header
+		}},
+		{name: "query changed", target: "/api/v1/signed?page=2", sign: func(req *http.Request) {
+			req.Header = signedRequest(t, key, "/api/v1/signed?page=1", body).Header
+		}},
+		{name: "other key", sign: func(req *http.Request) {
+			req.Header = signedRequest(t, randomKey(t, key.ID, KeyPrimary), "/api/v1/signed", body).Header
+		}},
+		{name: "unknown key", sign: func(req *http.Request) {
+			req.Header = signedRequest(t, randomKey(t, "transport-9", KeyPrimary), "/api/v1/signed", body).Header
+		}},
+		{name: "too old", sign: func(req *http.Request) { signAt(req, time.Now().Add(-DefaultSignatureWindow-time.Minute)) }},
+		{name: "too far ahead", sign: func(req *http.Request) { signAt(req, time.Now().Add(DefaultSignatureWindow+time.Minute)) }},
+		{name: "short nonce", sign: func(req *http.Request) {
+			signAt(req, time.Now())
+			req.Header.Set(SignatureNonceHeader, "short")
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			target := tc.target
+			if target == "" {
+				target = "/api/v1/signed"
+			}
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+			tc.sign(req)
+			req.Header.Set("Content-Type", "application/json")
+			if w := serveRequest(r, req); w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusUnauthorized, w.Body)
+			}
+		})
+	}
+
+	// Within the window either side of now is fine
+	for _, skew := range []time.Duration{-DefaultSignatureWindow + time.Minute, DefaultSignatureWindow - time.Minute} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/signed", strings.NewReader(body))
+		signAt(req, time.Now().Add(skew))
+		req.Header.Set("Content-Type", "application/json")
+		if w := serveRequest(r, req); w.Code != http.StatusOK {
+			t.Errorf("skew %s: status = %d: %s", skew, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSignedStreamRequest(t *testing.T) {
+	r, m := newSignedTestRouter(t)
+	key := m.keyring.Primary()
+	sealed := sealStream(t, key, 16, []byte(`{"email":"jane@example.com"}`))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/signed", strings.NewReader(string(sealed)))
+	req.Header.Set("Content-Type", mime.FormatMediaType(StreamContentType, nil))
+	if err := SignRequest(req, key); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveRequest(r, req); w.Code != http.StatusOK {
+		t.Errorf("status = %d: %s", w.Code, w.Body)
+	}
+
+	// A stream with another header (salt) is not the one signed
+	other := sealStream(t, key, 16, []byte(`{"email":"jane@example.com"}`))
+	forged := httptest.NewRequest(http.MethodPost, "/api/v1/signed", strings.NewReader(string(other)))
+	forged.Header = req.Header.Clone()
+	forged.Header.Set(SignatureNonceHeader, req.Header.Get(SignatureNonceHeader)+"x")
+	if w := serveRequest(r, forged); w.Code != http.StatusUnauthorized {
+		t.Errorf("other stream status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestSignedRequestNonceStoreFull(t *testing.T) {
+	r, m := newSignedTestRouter(t, WithNonceStore(NewMemoryNonceStore(1), DefaultSignatureWindow))
+	key := m.keyring.Primary()
+	body := `{"email":"` + mustSeal(t, key, "jane@example.com") + `"}`
+
+	if w := serveRequest(r, signedRequest(t, key, "/api/v1/signed", body)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if w := serveRequest(r, signedRequest(t, key, "/api/v1/signed", body)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with a full nonce store = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryNonceStore(3)
+
+	if err := store.Remember("a", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remember("a", now.Add(time.Hour)); !errors.Is(err, ErrNonceReused) {
+		t.Errorf("reused nonce = %v, want ErrNonceReused", err)
+	}
+
+	// Expiries out of arrival order: b arrived after a but expires first
+	if err := store.Remember("b", now.Add(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remember("c", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	// The store is full, but b has expired, so there is room for d without forgetting a or c
+	if err := store.Remember("d", now.Add(time.Hour)); err != nil {
+		t.Errorf("Remember with an expired nonce to purge = %v", err)
+	}
+	for _, nonce := range []string{"a", "c", "d"} {
+		if err := store.Remember(nonce, now.Add(time.Hour)); !errors.Is(err, ErrNonceReused) {
+			t.Errorf("%s after the purge = %v, want ErrNonceReused", nonce, err)
+		}
+	}
+
+	// Full of live nonces: refuse rather than forget one
+	if err := store.Remember("e", now.Add(time.Hour)); !errors.Is(err, ErrNonceStoreFull) {
+		t.Errorf("Remember on a full store = %v, want ErrNonceStoreFull", err)
+	}
+
+	// An expired nonce may be used again
+	fresh := NewMemoryNonceStore(3)
+	if err := fresh.Remember("x", now.Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.Remember("x", now.Add(time.Hour)); err != nil {
+		t.Errorf("reusing an expired nonce = %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sivInfo derives AES-SIV keys from data keys, so a data key never seals
+// with AES-SIV and AES-GCM under the same key.
+const sivInfo = "encryption-test aes-siv v1"
+
+var errSIVOpen = errors.New("aes-siv: authentication failed")
+
+// siv is AES-SIV (RFC 5297): a deterministic AEAD where the synthetic IV is a
+// CMAC-based PRF of the associated data and plaintext. Equal inputs give equal
+// ciphertext, which is what makes equality lookups possible, and nothing but
+// equality leaks. It implements cipher.AEAD with an empty nonce; a non-empty
+// nonce is treated as one more associated data component, as in the RFC.
+type siv struct {
+	mac cipher.Block // K1, for S2V
+	ctr cipher.Block // K2, for CTR
+}
+
+// newSIV builds AES-SIV from a key whose first half is the S2V key and
+// second half the CTR key: 32, 48 or 64 bytes.
+func newSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 && len(key) != 48 && len(key) != 64 {
+		return nil, errors.New("aes-siv: key must be 32, 48 or 64 bytes")
+	}
+	mac, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &siv{mac: mac, ctr: ctr}, nil
+}
+
+// newSIVFromKey expands a 32-byte keyring key into an AES-SIV-512 key.
+func newSIVFromKey(material []byte) (cipher.AEAD, error) {
+	key := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, nil, []byte(sivInfo)), key); err != nil {
+		return nil, err
+	}
+	return newSIV(key)
+}
+
+func (s *siv) NonceSize() int { return 0 }
+func (s *siv) Overhead() int  { return aes.BlockSize }
+
+func (s *siv) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	v := s.s2v(s.components(nonce, additionalData), plaintext)
+	ret, out := sliceForAppend(dst, len(v)+len(plaintext))
+	copy(out, v)
+	s.xorKeyStream(out[len(v):], plaintext, v)
+	return ret
+}
+
+func (s *siv) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errSIVOpen
+	}
+	v, sealed := ciphertext[:aes.BlockSize], ciphertext[aes.BlockSize:]
+	ret, out := sliceForAppend(dst, len(sealed))
+	s.xorKeyStream(out, sealed, v)
+	if subtle.ConstantTimeCompare(v, s.s2v(s.components(nonce, additionalData), out)) != 1 {
+		clear(out)
+		return nil, errSIVOpen
+	}
+	return ret, nil
+}
+
+func (s *siv) components(nonce, additionalData []byte) [][]byte {
+	components := [][]byte{additionalData}
+	if len(nonce) > 0 {
+		components = append(components, nonce)
+	}
+	return components
+}
+
+// xorKeyStream runs CTR mode from the synthetic IV with bits 31 and 63
+// cleared (RFC 5297 section 2.6), so implementations may use 64-bit counters.
+func (s *siv) xorKeyStream(dst, src, v []byte) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+	cipher.NewCTR(s.ctr, iv).XORKeyStream(dst, src)
+}
+
+// s2v is the S2V PRF over the associated data components and the plaintext.
+func (s *siv) s2v(components [][]byte, plaintext []byte) []byte {
+	d := s.cmac(make([]byte, aes.BlockSize))
+	for _, component := range components {
+		dbl(d)
+		subtle.XORBytes(d, d, s.cmac(component))
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte(nil), plaintext...)
+		subtle.XORBytes(t[len(t)-aes.BlockSize:], t[len(t)-aes.BlockSize:], d)
+	} else {
+		dbl(d)
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		subtle.XORBytes(t, t, d)
+	}
+	return s.cmac(t)
+}
+
+// cmac is AES-CMAC (RFC 4493) under the S2V key.
+func (s *siv) cmac(message []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	s.mac.Encrypt(k1, k1)
+	dbl(k1)
+	k2 := append([]byte(nil), k1...)
+	dbl(k2)
+
+	blocks := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	complete := blocks > 0 && len(message)%aes.BlockSize == 0
+	if blocks == 0 {
+		blocks = 1
+	}
+
+	last := make([]byte, aes.BlockSize)
+	tail := message[(blocks-1)*aes.BlockSize:]
+	if complete {
+		subtle.XORBytes(last, tail, k1)
+	} else {
+		copy(last, tail)
+		last[len(tail)] = 0x80
+		subtle.XORBytes(last, last, k2)
+	}
+
+	x := make([]byte, aes.BlockSize)
+	for i := 0; i < blocks-1; i++ {
+		subtle.XORBytes(x, x, message[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		s.mac.Encrypt(x, x)
+	}
+	subtle.XORBytes(x, x, last)
+	s.mac.Encrypt(x, x)
+	return x
+}
+
+// dbl multiplies a block by x in GF(2^128), in place.
+func dbl(block []byte) {
+	carry := block[0] >> 7
+	for i := 0; i < len(block)-1; i++ {
+		block[i] = block[i]<<1 | block[i+1]>>7
+	}
+	block[len(block)-1] = block[len(block)-1]<<1 ^ 0x87*carry
+}
+
+// sliceForAppend extends in by n bytes, as the standard library AEADs do.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
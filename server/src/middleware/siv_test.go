@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestSIVKnownAnswer is RFC 5297 A.1, deterministic authenticated encryption.
+func TestSIVKnownAnswer(t *testing.T) {
+	aead, err := newSIV(mustHex(t, "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := mustHex(t, "101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := mustHex(t, "112233445566778899aabbccddee")
+	want := mustHex(t, "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")
+
+	sealed := aead.Seal(nil, nil, plaintext, ad)
+	if !bytes.Equal(sealed, want) {
+		t.Errorf("Seal = %x, want %x", sealed, want)
+	}
+	opened, err := aead.Open(nil, nil, want, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open = %x, want %x", opened, plaintext)
+	}
+
+	for name, tc := range map[string]struct{ ciphertext, ad []byte }{
+		"tampered ciphertext": {append(append([]byte{}, want[:len(want)-1]...), want[len(want)-1]^1), ad},
+		"tampered IV":         {append([]byte{want[0] ^ 1}, want[1:]...), ad},
+		"other AD":            {want, ad[1:]},
+		"short":               {want[:15], ad},
+	} {
+		if _, err := aead.Open(nil, nil, tc.ciphertext, tc.ad); err == nil {
+			t.Errorf("%s: Open succeeded", name)
+		}
+	}
+}
+
+func TestSIVKeySizes(t *testing.T) {
+	for _, size := range []int{32, 48, 64} {
+		if _, err := newSIV(make([]byte, size)); err != nil {
+			t.Errorf("%d-byte key: %v", size, err)
+		}
+	}
+	for _, size := range []int{16, 33, 128} {
+		if _, err := newSIV(make([]byte, size)); err == nil {
+			t.Errorf("%d-byte key accepted", size)
+		}
+	}
+}
+
+func TestSIVDeterministic(t *testing.T) {
+	key := randomKey(t, "siv-1", KeyPrimary)
+	aead, err := newSIVFromKey(key.Material)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every plaintext length around a block boundary takes a different S2V branch
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plaintext := bytes.Repeat([]byte{'a'}, size)
+		first := aead.Seal(nil, nil, plaintext, []byte("ad"))
+		if second := aead.Seal(nil, nil, plaintext, []byte("ad")); !bytes.Equal(first, second) {
+			t.Errorf("%d bytes: Seal is not deterministic", size)
+		}
+		if other := aead.Seal(nil, []byte("nonce"), plaintext, []byte("ad")); bytes.Equal(first, other) {
+			t.Errorf("%d bytes: a nonce did not change the ciphertext", size)
+		}
+		opened, err := aead.Open(nil, nil, first, []byte("ad"))
+		if err != nil || !bytes.Equal(opened, plaintext) {
+			t.Errorf("%d bytes: Open = %x, %v", size, opened, err)
+		}
+	}
+
+	keyring := randomKeyring(t, "siv-1")
+	first, err := sealEnvelope(SuiteSIV, keyring.Primary(), []byte(`"jane@example.com"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := sealEnvelope(SuiteSIV, keyring.Primary(), []byte(`"jane@example.com"`))
+	other, _ := sealEnvelope(SuiteSIV, keyring.Primary(), []byte(`"john@example.com"`))
+	if first != second || first == other {
+		t.Errorf("SIV envelopes %q, %q and %q: want equal values to match and others not to", first, second, other)
+	}
+	if !strings.HasPrefix(first, "v2:siv:siv-1:") {
+		t.Errorf("envelope %q, want prefix v2:siv:siv-1:", first)
+	}
+	plaintext, err := openDataEnvelope(keyring, first)
+	if err != nil || string(plaintext) != `"jane@example.com"` {
+		t.Errorf("openDataEnvelope = %s, %v", plaintext, err)
+	}
+}
@@ -0,0 +1,351 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/hkdf"
+)
+
+// StreamContentType marks a body encrypted segment by segment, so neither
+// side has to hold the whole body in memory. The plaintext media type goes
+// in the "type" parameter, e.g.
+//
+//	application/vnd.encrypted-stream; type="text/csv"
+//
+// and defaults to application/json.
+const StreamContentType = "application/vnd.encrypted-stream"
+
+const (
+	DefaultStreamSegmentSize = 64 << 10
+	// maxStreamSegmentSize bounds the memory a client can make us allocate per segment
+	maxStreamSegmentSize = 4 << 20
+
+	streamVersion     = 1
+	streamSaltSize    = 16
+	streamPrefixSize  = 7
+	streamInfo        = "encryption-test stream v1"
+	streamContextKey  = "cryptoStream"
+	streamDefaultType = "application/json"
+)
+
+var ErrInvalidStream = errors.New("invalid encrypted stream")
+
+// The stream format is a STREAM construction (Hoang et al.) over AES-256-GCM:
+//
+//	header  = version(1) || len(kid)(1) || kid || segment size(4) || salt(16) || nonce prefix(7)
+//	segment = AES-GCM(segment key, nonce prefix || counter(4) || last(1), plaintext, aad = header)
+//
+// The segment key is HKDF-SHA256(keyring key, salt, streamInfo), so every
+// stream has its own key. Each segment holds up to segment size bytes of
+// plaintext; only the final one has last = 1, so truncating or reordering
+// segments fails authentication.
+type streamHeader struct {
+	kid         string
+	segmentSize int
+	salt        []byte
+	prefix      []byte
+	raw         []byte
+}
+
+func (h *streamHeader) aead(key Key) (cipher.AEAD, error) {
+	segmentKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key.Material, h.salt, []byte(streamInfo)), segmentKey); err != nil {
+		return nil, err
+	}
+	return newGCM(segmentKey)
+}
+
+func (h *streamHeader) nonce(counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, h.prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// streamWriter encrypts everything written to it. Close must be called to
+// write the final segment.
+type streamWriter struct {
+	w       io.Writer
+	header  *streamHeader
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint32
+	closed  bool
+}
+
+func newStreamWriter(w io.Writer, key Key, segmentSize int) (*streamWriter, error) {
+	if len(key.ID) > 255 {
+		return nil, fmt.Errorf("key id %q is too long for a stream header", key.ID)
+	}
+	header := &streamHeader{
+		kid:         key.ID,
+		segmentSize: segmentSize,
+		salt:        make([]byte, streamSaltSize),
+		prefix:      make([]byte, streamPrefixSize),
+	}
+	if _, err := rand.Read(header.salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(header.prefix); err != nil {
+		return nil, err
+	}
+	raw := []byte{streamVersion, byte(len(key.ID))}
+	raw = append(raw, key.ID...)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(segmentSize))
+	raw = append(raw, header.salt...)
+	raw = append(raw, header.prefix...)
+	header.raw = raw
+
+	aead, err := header.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	return &streamWriter{w: w, header: header, aead: aead, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data arrives, since the
+		// final segment has to be marked as such.
+		if len(s.buf) == s.header.segmentSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(s.buf[len(s.buf):s.header.segmentSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *streamWriter) seal(last bool) error {
+	if s.counter == ^uint32(0) {
+		return errors.New("stream has too many segments")
+	}
+	sealed := s.aead.Seal(nil, s.header.nonce(s.counter, last), s.buf, s.header.raw)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// streamReader decrypts a stream produced by streamWriter, one segment at a time.
+type streamReader struct {
+	r       *bufio.Reader
+	header  *streamHeader
+	aead    cipher.AEAD
+	segment []byte // ciphertext buffer
+	plain   []byte // decrypted bytes not yet returned
+	counter uint32
+	done    bool
+}
+
+// newStreamReader reads the stream header and looks its key up in the ring.
+func newStreamReader(r io.Reader, keyring *Keyring) (*streamReader, error) {
+	br := bufio.NewReader(r)
+	fixed := make([]byte, 2)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidStream, err)
+	}
+	if fixed[0] != streamVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidStream, fixed[0])
+	}
+	rest := make([]byte, int(fixed[1])+4+streamSaltSize+streamPrefixSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidStream, err)
+	}
+
+	kidLen := int(fixed[1])
+	header := &streamHeader{
+		kid:         string(rest[:kidLen]),
+		segmentSize: int(binary.BigEndian.Uint32(rest[kidLen:])),
+		salt:        rest[kidLen+4 : kidLen+4+streamSaltSize],
+		prefix:      rest[kidLen+4+streamSaltSize:],
+		raw:         append(fixed, rest...),
+	}
+	if header.segmentSize <= 0 || header.segmentSize > maxStreamSegmentSize {
+		return nil, fmt.Errorf("%w: segment size %d out of range", ErrInvalidStream, header.segmentSize)
+	}
+
+	key, err := keyring.Lookup(header.kid)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &streamReader{
+		r:       br,
+		header:  header,
+		aead:    aead,
+		segment: make([]byte, header.segmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *streamReader) next() error {
+	n, err := io.ReadFull(s.r, s.segment)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		// A short segment can only be the final one
+		s.done = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is final only if nothing follows it
+		if _, peekErr := s.r.Peek(1); peekErr == io.EOF {
+			s.done = true
+		} else if peekErr != nil {
+			return peekErr
+		}
+	}
+
+	plain, err := s.aead.Open(s.segment[:0:0], s.header.nonce(s.counter, s.done), s.segment[:n], s.header.raw)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d failed authentication", ErrInvalidStream, s.counter)
+	}
+	s.counter++
+	s.plain = plain
+	return nil
+}
+
+func (s *streamReader) Close() error {
+	return nil
+}
+
+// streamResponseWriter encrypts the response as it is written instead of
+// buffering it. Error responses are sent as they are.
+type streamResponseWriter struct {
+	gin.ResponseWriter
+	key         Key
+	segmentSize int
+	stream      *streamWriter
+	passthrough bool
+}
+
+func (w *streamResponseWriter) Write(b []byte) (int, error) {
+	if w.stream == nil && !w.passthrough {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.stream.Write(b)
+}
+
+func (w *streamResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *streamResponseWriter) start() error {
+	if w.Status() >= 400 {
+		w.passthrough = true
+		return nil
+	}
+	plainType := w.Header().Get("Content-Type")
+	if plainType == "" {
+		plainType = streamDefaultType
+	}
+	w.Header().Set("Content-Type", mime.FormatMediaType(StreamContentType, map[string]string{"type": plainType}))
+	w.Header().Del("Content-Length")
+	w.Header().Set(PayloadEncryptionHeader, string(PayloadV2))
+
+	stream, err := newStreamWriter(flushWriter{w.ResponseWriter}, w.key, w.segmentSize)
+	if err != nil {
+		return err
+	}
+	w.stream = stream
+	return nil
+}
+
+// Close writes the final segment if anything was encrypted.
+func (w *streamResponseWriter) Close() error {
+	if w.stream == nil {
+		return nil
+	}
+	return w.stream.Close()
+}
+
+// flushWriter sends every segment to the client as soon as it is sealed.
+type flushWriter struct {
+	w gin.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.w.Flush()
+	return n, err
+}
+
+// streamContentType reports whether value is StreamContentType and returns the plaintext media type.
+func streamContentType(value string) (bool, string) {
+	mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(value))
+	if err != nil || mediaType != StreamContentType {
+		return false, ""
+	}
+	if params["type"] == "" {
+		return true, streamDefaultType
+	}
+	return true, params["type"]
+}
+
+// wantsStreamResponse reports whether the request was a stream or the client
+// listed StreamContentType in Accept.
+func wantsStreamResponse(c *gin.Context) bool {
+	if c.GetBool(streamContextKey) {
+		return true
+	}
+	for _, accepted := range strings.Split(c.GetHeader("Accept"), ",") {
+		if ok, _ := streamContentType(accepted); ok {
+			return true
+		}
+	}
+	return false
+}
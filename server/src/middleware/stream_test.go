@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func sealStream(t *testing.T, key Key, segmentSize int, plaintext []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	stream, err := newStreamWriter(&sealed, key, segmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd write sizes, so segments do not line up with writes
+	for rest := plaintext; len(rest) > 0; {
+		n := len(rest)
+		if n > 3 {
+			n = 3
+		}
+		if _, err := stream.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func openStream(keyring *Keyring, sealed []byte) ([]byte, error) {
+	stream, err := newStreamReader(bytes.NewReader(sealed), keyring)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(stream)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	keyring := randomKeyring(t, "transport-1")
+	key := keyring.Primary()
+	for _, size := range []int{0, 1, 7, 8, 9, 64, 100} {
+		plaintext := make([]byte, size)
+		if _, err := rand.Read(plaintext); err != nil {
+			t.Fatal(err)
+		}
+		got, err := openStream(keyring, sealStream(t, key, 8, plaintext))
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%d bytes: round trip gave %x, want %x", size, got, plaintext)
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	keyring := randomKeyring(t, "transport-1")
+	key := keyring.Primary()
+	const segmentSize = 8
+	sealed := sealStream(t, key, segmentSize, []byte("0123456789abcdefXYZ")) // segments of 8, 8 and 3 bytes
+	headerSize := 2 + len(key.ID) + 4 + streamSaltSize + streamPrefixSize
+	segment := segmentSize + 16
+	header, first, second, final := sealed[:headerSize], sealed[headerSize:headerSize+segment],
+		sealed[headerSize+segment:headerSize+2*segment], sealed[headerSize+2*segment:]
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	flipped := append([]byte{}, sealed...)
+	flipped[headerSize+3] ^= 1
+	otherHeader := append([]byte{}, sealed...)
+	otherHeader[headerSize-1] ^= 1 // last byte of the nonce prefix
+
+	for _, tc := range []struct {
+		name   string
+		sealed []byte
+	}{
+		{"final segment dropped", join(header, first, second)},
+		{"segments reordered", join(header, second, first, final)},
+		{"segment repeated", join(header, first, first, second, final)},
+		{"ciphertext changed", flipped},
+		{"header changed", otherHeader},
+		{"final segment cut short", sealed[:len(sealed)-1]},
+		{"only the header", header},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := openStream(keyring, tc.sealed); !errors.Is(err, ErrInvalidStream) {
+				t.Errorf("open = %v, want ErrInvalidStream", err)
+			}
+		})
+	}
+
+	if _, err := openStream(randomKeyring(t, "transport-2"), sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("open with another keyring = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestStreamRejectsSegmentSize(t *testing.T) {
+	keyring := randomKeyring(t, "transport-1")
+	key := keyring.Primary()
+	for _, size := range []int{0, maxStreamSegmentSize + 1} {
+		var sealed bytes.Buffer
+		if _, err := newStreamWriter(&sealed, key, 8); err != nil {
+			t.Fatal(err)
+		}
+		raw := sealed.Bytes()
+		sizeAt := 2 + len(key.ID)
+		raw[sizeAt], raw[sizeAt+1], raw[sizeAt+2], raw[sizeAt+3] = byte(size>>24), byte(size>>16), byte(size>>8), byte(size)
+		if _, err := newStreamReader(bytes.NewReader(raw), keyring); !errors.Is(err, ErrInvalidStream) {
+			t.Errorf("segment size %d: %v, want ErrInvalidStream", size, err)
+		}
+	}
+}
+
+func TestStreamRequestAndResponse(t *testing.T) {
+	m := newTestMiddleware(t, nil, WithStreamSegmentSize(16))
+	r := newTestRouter(m, func(c *gin.Context) {
+		if got := c.ContentType(); got != "text/csv" {
+			t.Errorf("handler Content-Type = %q, want text/csv", got)
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Error(NewAppError(http.StatusBadRequest, err.Error(), nil))
+			return
+		}
+		c.Data(http.StatusOK, "text/csv", bytes.ToUpper(body))
+	})
+	csv := strings.Repeat("id,email\n1,jane@example.com\n", 10)
+	contentType := mime.FormatMediaType(StreamContentType, map[string]string{"type": "text/csv"})
+
+	sealed := sealStream(t, m.keyring.Primary(), 16, []byte(csv))
+	w := serve(r, http.MethodPost, "/api/v1/export", contentType, string(sealed), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	ok, plainType := streamContentType(w.Header().Get("Content-Type"))
+	if !ok || plainType != "text/csv" {
+		t.Errorf("response Content-Type = %q, want a text/csv stream", w.Header().Get("Content-Type"))
+	}
+	response, err := openStream(m.keyring, w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != strings.ToUpper(csv) {
+		t.Errorf("response = %q", response)
+	}
+
+	// The handler sees the truncation as a read error
+	truncated := sealed[:len(sealed)-(len(csv)%16+16)]
+	w = serve(r, http.MethodPost, "/api/v1/export", contentType, string(truncated), nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("truncated stream status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// PayloadCipherHeader lets a client pick the Suite the server encrypts its
+// responses with. Requests may mix suites, since every envelope names its own.
+const PayloadCipherHeader = "X-Payload-Cipher"
+
+// Suite is the AEAD used for v2 envelopes.
+type Suite string
+
+const (
+	// SuiteAESGCM is AES-256-GCM, the default.
+	SuiteAESGCM Suite = "a256gcm"
+	// SuiteChaCha20 is ChaCha20-Poly1305 (RFC 8439), fast on devices without AES instructions.
+	SuiteChaCha20 Suite = "c20p"
+	// SuiteXChaCha20 is XChaCha20-Poly1305, whose 24-byte nonces are safe to pick at random for any number of messages.
+	SuiteXChaCha20 Suite = "xc20p"
+	// SuiteSIV is AES-SIV (RFC 5297), a deterministic AEAD for columns that
+	// must support equality lookups, see DataCipher.EncryptDeterministic. It
+	// is for data at rest only and never a transport suite.
+	SuiteSIV Suite = "siv"
+)
+
+// ParseSuite parses a transport suite. SuiteSIV is not one.
+func ParseSuite(s string) (Suite, error) {
+	switch suite := Suite(strings.ToLower(strings.TrimSpace(s))); suite {
+	case "":
+		return SuiteAESGCM, nil
+	case SuiteAESGCM, SuiteChaCha20, SuiteXChaCha20:
+		return suite, nil
+	default:
+		return "", fmt.Errorf("unknown cipher suite %q", s)
+	}
+}
+
+// parseDataSuite parses the suite of an envelope kept at rest: a transport
+// suite, or SuiteSIV for values that are looked up by equality.
+func parseDataSuite(s string) (Suite, error) {
+	if Suite(s) == SuiteSIV {
+		return SuiteSIV, nil
+	}
+	return ParseSuite(s)
+}
+
+// sealedOverhead is the size of the nonce and tag in the payload of an
+// envelope sealed with suite.
+func sealedOverhead(suite Suite) int {
+	switch suite {
+	case SuiteXChaCha20:
+		return chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+	case SuiteSIV:
+		return aes.BlockSize
+	default:
+		// AES-GCM and ChaCha20-Poly1305 both use 12-byte nonces and 16-byte tags
+		return chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+	}
+}
+
+func newAEAD(suite Suite, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case SuiteAESGCM:
+		return newGCM(key)
+	case SuiteChaCha20:
+		return chacha20poly1305.New(key)
+	case SuiteXChaCha20:
+		return chacha20poly1305.NewX(key)
+	case SuiteSIV:
+		return newSIVFromKey(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher suite %q", suite)
+	}
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseSuite(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Suite
+		ok   bool
+	}{
+		{"", SuiteAESGCM, true},
+		{"a256gcm", SuiteAESGCM, true},
+		{" C20P ", SuiteChaCha20, true},
+		{"xc20p", SuiteXChaCha20, true},
+		{"siv", "", false},
+		{"aes-cbc", "", false},
+	} {
+		got, err := ParseSuite(tc.in)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("ParseSuite(%q) = %q, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestSuiteEnvelopes(t *testing.T) {
+	keyring := randomKeyring(t, "key-1")
+	for _, tc := range []struct {
+		suite  Suite
+		prefix string
+	}{
+		{SuiteAESGCM, "v2:key-1:"},
+		{SuiteChaCha20, "v2:c20p:key-1:"},
+		{SuiteXChaCha20, "v2:xc20p:key-1:"},
+	} {
+		envelope, err := sealEnvelope(tc.suite, keyring.Primary(), []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(envelope, tc.prefix) {
+			t.Errorf("%s envelope %q, want prefix %q", tc.suite, envelope, tc.prefix)
+		}
+		plaintext, err := openEnvelope(keyring, envelope)
+		if err != nil || string(plaintext) != "secret" {
+			t.Errorf("%s: openEnvelope = %q, %v", tc.suite, plaintext, err)
+		}
+
+		// An envelope only opens under its own suite
+		for _, other := range []Suite{SuiteAESGCM, SuiteChaCha20, SuiteXChaCha20} {
+			if other == tc.suite {
+				continue
+			}
+			relabelled := "v2:" + string(other) + ":" + envelope[strings.Index(envelope, "key-1:"):]
+			if _, err := openEnvelope(keyring, relabelled); err == nil {
+				t.Errorf("%s envelope opened as %s", tc.suite, other)
+			}
+		}
+	}
+}
+
+func TestSuiteNegotiation(t *testing.T) {
+	m := newTestMiddleware(t, nil)
+	r := newTestRouter(m, echoJSON)
+	key := m.keyring.Primary()
+
+	// Requests may mix suites; the response uses the one asked for
+	request := map[string]string{}
+	for _, suite := range []Suite{SuiteAESGCM, SuiteChaCha20, SuiteXChaCha20} {
+		plaintext, _ := json.Marshal("value in " + string(suite))
+		envelope, err := sealEnvelope(suite, key, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request[string(suite)] = envelope
+	}
+	body, _ := json.Marshal(request)
+
+	for _, tc := range []struct {
+		header string
+		want   Suite
+		prefix string
+	}{
+		{"", SuiteAESGCM, "v2:transport-1:"},
+		{"c20p", SuiteChaCha20, "v2:c20p:transport-1:"},
+		{"xc20p", SuiteXChaCha20, "v2:xc20p:transport-1:"},
+	} {
+		header := http.Header{}
+		if tc.header != "" {
+			header.Set(PayloadCipherHeader, tc.header)
+		}
+		w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", string(body), header)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", tc.want, w.Code, w.Body)
+		}
+		if got := w.Header().Get(PayloadCipherHeader); got != string(tc.want) {
+			t.Errorf("%s: response %s = %q", tc.want, PayloadCipherHeader, got)
+		}
+		for name, envelope := range responseData(t, w).(map[string]interface{}) {
+			if !strings.HasPrefix(envelope.(string), tc.prefix) {
+				t.Errorf("%s: %s = %q, want prefix %q", tc.want, name, envelope, tc.prefix)
+			}
+			if got := mustOpen(t, m.keyring, envelope); got != "value in "+name {
+				t.Errorf("%s: %s = %v", tc.want, name, got)
+			}
+		}
+	}
+
+	for _, bad := range []string{"siv", "rot13"} {
+		w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", string(body), http.Header{PayloadCipherHeader: {bad}})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status = %d, want %d", PayloadCipherHeader, bad, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestWithSuite(t *testing.T) {
+	m := newTestMiddleware(t, nil, WithSuite(SuiteXChaCha20))
+	r := newTestRouter(m, echoJSON)
+	body := `{"name":"` + mustSeal(t, m.keyring.Primary(), "Jane") + `"}`
+
+	w := serve(r, http.MethodPost, "/api/v1/echo", "application/json", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	name := responseData(t, w).(map[string]interface{})["name"]
+	if !strings.HasPrefix(name.(string), "v2:xc20p:") {
+		t.Errorf("name = %q, want an xc20p envelope", name)
+	}
+	if got := mustOpen(t, m.keyring, name); got != "Jane" {
+		t.Errorf("name = %v", got)
+	}
+
+	if _, err := NewCryptoMiddleware(staticKeyProvider{&KeySet{Keyring: m.keyring, IV: m.iv}}, ModeGCM, WithSuite(SuiteSIV)); err == nil {
+		t.Error("NewCryptoMiddleware accepted SIV as the transport suite")
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+type HandshakeRequest struct {
+	PublicKey string `json:"public_key" binding:"required" validate:"required"` // base64 X25519 public key
+} //@name HandshakeRequest
+
+type HandshakeResponse struct {
+	SessionID string    `json:"session_id"`
+	PublicKey string    `json:"public_key"` // base64 X25519 public key
+	Salt      string    `json:"salt"`       // base64 HKDF salt
+	ExpiresAt time.Time `json:"expires_at"`
+} //@name HandshakeResponse
+
+// LoginResponse is the user plus the key of the login session started for
+// them. The key is only ever sent encrypted.
+type LoginResponse struct {
+	User
+	Session SessionKey `json:"session"`
+} //@name LoginResponse
+
+type SessionKey struct {
+	SessionID string    `json:"session_id"`
+	Key       string    `json:"key" crypt:"encrypt"` // base64 AES-256 session key
+	ExpiresAt time.Time `json:"expires_at"`
+} //@name SessionKey
@@ -8,9 +8,12 @@ import (
 
 type User struct {
 	ID          uuid.UUID    `json:"id" gorm:"column:id; primary_key" swaggerignore:"true"`
-	FirstName   string       `json:"first_name"`
-	LastName    string       `json:"last_name"`
-	Email       string       `json:"email" gorm:"unique" binding:"required" validate:"required,email"`
+	FirstName   string       `json:"first_name" gorm:"serializer:encrypted" crypt:"encrypt"`
+	LastName    string       `json:"last_name" gorm:"serializer:encrypted" crypt:"encrypt"`
+	Email       string       `json:"email" gorm:"serializer:encrypted" binding:"required" validate:"required,email" crypt:"encrypt"`
+	// EmailIndex is the blind index of the normalized email, which lookups and
+	// the unique constraint use since the email itself is encrypted
+	EmailIndex  string       `json:"-" gorm:"column:email_index;uniqueIndex" swaggerignore:"true"`
 	Password    string       `json:"-" gorm:"column:password" binding:"required" validate:"required,min=6,max=20"`
 	CreatedAt   time.Time    `json:"created_at" default:"current_timestamp"`
 	UpdatedAt   time.Time    `json:"updated_at" default:"current_timestamp"`
@@ -23,9 +26,9 @@ type Login struct {
 } //@name Login
 
 type Register struct {
-	FirstName string `json:"first_name" binding:"required" validate:"required,min=2,max=20"`
-	LastName  string `json:"last_name" binding:"required" validate:"required,min=2,max=20"`
-	Email     string `json:"email" binding:"required" validate:"required,email"`
-	Password  string `json:"password" binding:"required" validate:"required,min=6,max=20"`
+	FirstName string `json:"first_name" binding:"required,min=2,max=20" validate:"required,min=2,max=20"`
+	LastName  string `json:"last_name" binding:"required,min=2,max=20" validate:"required,min=2,max=20"`
+	Email     string `json:"email" binding:"required,email" validate:"required,email"`
+	Password  string `json:"password" binding:"required,min=6,max=20" validate:"required,min=6,max=20"`
 } //@name Register
 
@@ -1,10 +1,14 @@
 package repository
 
 import (
+	"fmt"
+	"strings"
+
 	db "github.com/Software78/encryption-test/src/db"
 	"github.com/Software78/encryption-test/src/models"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type UserRepository interface {
@@ -13,23 +17,61 @@ type UserRepository interface {
 	Register(register *models.Register) (*models.User, error)
 	GetUserByID(id uuid.UUID) (*models.User, error)
 	GetUserByEmail(email string) (*models.User, error)
+	BackfillEmailIndex(batchSize int) (int64, error)
+}
+
+// Indexer computes blind indexes, keyed hashes that let encrypted columns be
+// matched without decrypting them. middleware.BlindIndex implements it.
+type Indexer interface {
+	Index(value string) string
+	// Candidates returns the index under every key, for lookups during a key rotation
+	Candidates(value string) []string
+}
+
+// EmailIndexConflictError is returned by BackfillEmailIndex when emails of
+// different users normalize to the same index, which the unique index on
+// email_index can't hold. Nothing is updated until they are resolved.
+type EmailIndexConflictError struct {
+	// Conflicts holds the IDs of every group of users sharing an email.
+	Conflicts [][]uuid.UUID
+}
+
+func (e *EmailIndexConflictError) Error() string {
+	groups := make([]string, len(e.Conflicts))
+	for i, ids := range e.Conflicts {
+		names := make([]string, len(ids))
+		for j, id := range ids {
+			names[j] = id.String()
+		}
+		groups[i] = "[" + strings.Join(names, ", ") + "]"
+	}
+	return fmt.Sprintf("%d emails belong to more than one user once normalized: %s", len(e.Conflicts), strings.Join(groups, " "))
 }
 
 // Concrete implementation
 type userRepository struct {
-	db db.Database
+	db      db.Database
+	indexer Indexer
 }
 
-func NewUserRepository(db db.Database) UserRepository {
+func NewUserRepository(db db.Database, indexer Indexer) UserRepository {
 	return &userRepository{
-		db: db,
+		db:      db,
+		indexer: indexer,
 	}
 }
 
+// normalizeEmail is applied before indexing, so emails differing only in
+// case or surrounding spaces get the same index.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 
 
 func (r *userRepository) Create(user *models.User) error {
 	user.ID = uuid.New()
+	user.EmailIndex = r.indexer.Index(normalizeEmail(user.Email))
 	hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 15)
 	user.Password = string(hash)
 	if err := r.db.Create(&user).Error; err != nil {
@@ -40,7 +82,7 @@ func (r *userRepository) Create(user *models.User) error {
 
 func (r *userRepository) Login(login *models.Login) (*models.User, error) {
 	user := &models.User{}
-	if err := r.db.Where("email = ?", login.Email).First(&user).Error; err != nil {
+	if err := r.db.Where("email_index IN ?", r.indexer.Candidates(normalizeEmail(login.Email))).First(&user).Error; err != nil {
 		return nil, err
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(login.Password)); err != nil {
@@ -56,7 +98,7 @@ func (r *userRepository) Register(register *models.Register) (*models.User, erro
 		Email:     register.Email,
 		Password:  register.Password,
 		ID: 	  uuid.New(),
-		
+		EmailIndex: r.indexer.Index(normalizeEmail(register.Email)),
 	}
 	hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), 15)
 	user.Password = string(hash)
@@ -74,10 +116,73 @@ func (r *userRepository) GetUserByID(id uuid.UUID) (*models.User, error) {
 	return user, nil
 }
 
+// GetUserByEmail finds the user by the blind index of the email, since the
+// email column is encrypted.
 func (r *userRepository) GetUserByEmail(email string) (*models.User, error) {
 	user := &models.User{}
-	if err := r.db.Where("email = ?", email).First(&user).Error; err != nil {
+	if err := r.db.Where("email_index IN ?", r.indexer.Candidates(normalizeEmail(email))).First(&user).Error; err != nil {
 		return nil, err
 	}
 	return user, nil
-}
\ No newline at end of file
+}
+
+// BackfillEmailIndex sets the email index of users created before it
+// existed, or indexed with a key that is no longer primary. It returns the
+// number of users updated, or an *EmailIndexConflictError without updating
+// any user if emails collide once normalized.
+func (r *userRepository) BackfillEmailIndex(batchSize int) (int64, error) {
+	if err := r.checkEmailIndexConflicts(batchSize); err != nil {
+		return 0, err
+	}
+
+	var users []models.User
+	var updated int64
+	result := r.db.FindInBatches(&users, batchSize, func(_ *gorm.DB, _ int) error {
+		for i := range users {
+			index := r.indexer.Index(normalizeEmail(users[i].Email))
+			if users[i].EmailIndex == index {
+				continue
+			}
+			// UpdateColumn leaves updated_at alone
+			if err := r.db.Model(&users[i]).UpdateColumn("email_index", index).Error; err != nil {
+				return err
+			}
+			updated++
+		}
+		return nil
+	})
+	return updated, result.Error
+}
+
+// checkEmailIndexConflicts indexes every user without saving anything, so
+// users sharing an email are reported up front rather than failing the
+// unique index partway through the backfill.
+func (r *userRepository) checkEmailIndexConflicts(batchSize int) error {
+	owners := map[string][]uuid.UUID{}
+	var indexes []string // in the order found, for a stable report
+	var users []models.User
+	result := r.db.FindInBatches(&users, batchSize, func(_ *gorm.DB, _ int) error {
+		for _, user := range users {
+			index := r.indexer.Index(normalizeEmail(user.Email))
+			if _, ok := owners[index]; !ok {
+				indexes = append(indexes, index)
+			}
+			owners[index] = append(owners[index], user.ID)
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	var conflicts [][]uuid.UUID
+	for _, index := range indexes {
+		if len(owners[index]) > 1 {
+			conflicts = append(conflicts, owners[index])
+		}
+	}
+	if len(conflicts) > 0 {
+		return &EmailIndexConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	db "github.com/Software78/encryption-test/src/db"
+	"github.com/Software78/encryption-test/src/models"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// plainCipher lets models.User parse with its encrypted serializers.
+type plainCipher struct{}
+
+func (plainCipher) Encrypt(plaintext []byte) (string, error) { return string(plaintext), nil }
+func (plainCipher) EncryptDeterministic(plaintext []byte) (string, error) {
+	return string(plaintext), nil
+}
+func (plainCipher) Decrypt(ciphertext string) ([]byte, error) { return []byte(ciphertext), nil }
+func (plainCipher) IsEncrypted(string) bool                   { return false }
+
+// prefixIndexer indexes a value as the value with a prefix, so tests can read it.
+type prefixIndexer struct{}
+
+func (prefixIndexer) Index(value string) string        { return "idx:" + value }
+func (prefixIndexer) Candidates(value string) []string { return []string{"idx:" + value} }
+
+// fakeDatabase serves users in batches and records which users were
+// updated. Updates go to a dry-run connection, so no SQL is executed.
+type fakeDatabase struct {
+	db.Database
+	users   []models.User
+	updated []uuid.UUID
+	dryRun  *gorm.DB
+}
+
+func newFakeDatabase(t *testing.T, users ...models.User) *fakeDatabase {
+	t.Helper()
+	db.RegisterEncryptedSerializers(plainCipher{})
+	dryRun, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, SkipDefaultTransaction: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeDatabase{users: users, dryRun: dryRun}
+}
+
+func (f *fakeDatabase) FindInBatches(dest interface{}, batchSize int, fc func(tx *gorm.DB, batch int) error) *gorm.DB {
+	batch := dest.(*[]models.User)
+	for start, n := 0, 1; start < len(f.users); start, n = start+batchSize, n+1 {
+		*batch = append((*batch)[:0], f.users[start:min(start+batchSize, len(f.users))]...)
+		if err := fc(f.dryRun, n); err != nil {
+			return &gorm.DB{Error: err}
+		}
+	}
+	return &gorm.DB{}
+}
+
+func (f *fakeDatabase) Model(value interface{}) *gorm.DB {
+	f.updated = append(f.updated, value.(*models.User).ID)
+	return f.dryRun.Model(value)
+}
+
+func TestBackfillEmailIndex(t *testing.T) {
+	jane, john, ada := uuid.New(), uuid.New(), uuid.New()
+	database := newFakeDatabase(t,
+		models.User{ID: jane, Email: "Jane@example.com"},
+		models.User{ID: john, Email: "john@example.com", EmailIndex: "idx:john@example.com"},
+		models.User{ID: ada, Email: " ada@example.com ", EmailIndex: "idx:old-key"},
+	)
+	repository := NewUserRepository(database, prefixIndexer{})
+
+	updated, err := repository.BackfillEmailIndex(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uuid.UUID{jane, ada}; updated != 2 || !reflect.DeepEqual(database.updated, want) {
+		t.Errorf("updated %d users %v, want %v", updated, database.updated, want)
+	}
+}
+
+func TestBackfillEmailIndexConflicts(t *testing.T) {
+	jane, janeAgain, john, johnAgain, ada := uuid.New(), uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	database := newFakeDatabase(t,
+		models.User{ID: jane, Email: "jane@example.com"},
+		models.User{ID: john, Email: "john@example.com"},
+		models.User{ID: ada, Email: "ada@example.com"},
+		models.User{ID: janeAgain, Email: "JANE@example.com"},
+		models.User{ID: johnAgain, Email: " John@Example.com"},
+	)
+	repository := NewUserRepository(database, prefixIndexer{})
+
+	// The conflicting users are in different batches
+	updated, err := repository.BackfillEmailIndex(2)
+	var conflict *EmailIndexConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("BackfillEmailIndex = %v, want an EmailIndexConflictError", err)
+	}
+	if want := [][]uuid.UUID{{jane, janeAgain}, {john, johnAgain}}; !reflect.DeepEqual(conflict.Conflicts, want) {
+		t.Errorf("Conflicts = %v, want %v", conflict.Conflicts, want)
+	}
+	for _, id := range []uuid.UUID{jane, janeAgain, john, johnAgain} {
+		if !strings.Contains(err.Error(), id.String()) {
+			t.Errorf("error %q does not name user %s", err, id)
+		}
+	}
+	if updated != 0 || len(database.updated) != 0 {
+		t.Errorf("updated %d users %v before reporting the conflict", updated, database.updated)
+	}
+}